@@ -0,0 +1,133 @@
+// Command geoip looks up hosts the way the analyzer does and prints the GeoIP
+// info of each of their IPs, to debug why an app's hosts aren't geolocated
+// without running the whole pipeline.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sociam/xray-archiver/pipeline/util"
+)
+
+var cfgFile = flag.String("cfg", "/etc/xray/config.json", "config file location")
+var jsonOut = flag.Bool("json", false, "print the results as JSON")
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] host...\n\nFlags:\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// hostResult is the JSON output for a host.
+type hostResult struct {
+	Host  string     `json:"host"`
+	IPs   []ipResult `json:"ips,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+// ipResult is the JSON output for one of a host's IPs.
+type ipResult struct {
+	IP      string          `json:"ip"`
+	Info    *util.GeoIPInfo `json:"info,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Skipped bool            `json:"skipped,omitempty"`
+}
+
+// newHostResult converts res, whose errors can't be encoded as JSON, to a
+// hostResult.
+func newHostResult(res util.HostResolution) hostResult {
+	ret := hostResult{Host: res.Host}
+	if res.Err != nil {
+		ret.Error = res.Err.Error()
+	}
+	for _, r := range res.IPs {
+		ip := ipResult{IP: r.IP, Skipped: r.Skipped}
+		switch {
+		case r.Err != nil:
+			ip.Error = r.Err.Error()
+		case !r.Skipped:
+			info := r.Info
+			ip.Info = &info
+		}
+		ret.IPs = append(ret.IPs, ip)
+	}
+	return ret
+}
+
+// printResolution prints the GeoIP info of each of the IPs host resolved to,
+// or why it couldn't be looked up.
+func printResolution(res util.HostResolution) {
+	fmt.Printf("%s:\n", res.Host)
+	if res.Err != nil {
+		fmt.Printf("  error: %s\n", res.Err.Error())
+		return
+	}
+	if len(res.IPs) == 0 {
+		fmt.Println("  no IPs")
+	}
+	for _, r := range res.IPs {
+		switch {
+		case r.Skipped:
+			fmt.Printf("  %s: skipped (geoip_skip_v6)\n", r.IP)
+			continue
+		case r.Err != nil:
+			fmt.Printf("  %s: error: %s\n", r.IP, r.Err.Error())
+			continue
+		}
+
+		inf := r.Info
+		fmt.Printf("  %s: %s (%s)\n", r.IP, inf.CountryName, inf.CountryCode)
+		if inf.City != "" || inf.RegionName != "" {
+			fmt.Printf("    location: %s, %s (%.4f, %.4f)\n", inf.City, inf.RegionName, inf.Latitude, inf.Longitude)
+		}
+		if inf.ASN != 0 {
+			fmt.Printf("    asn:      AS%d %s\n", inf.ASN, inf.ASNOrg)
+		}
+		if len(inf.PTR) > 0 {
+			fmt.Printf("    ptr:      %s\n", strings.Join(inf.PTR, ", "))
+		}
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(64)
+	}
+
+	if err := util.LoadCfg(*cfgFile, util.Analyzer); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read config: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	failed := false
+	results := make([]hostResult, 0, flag.NArg())
+	for _, host := range flag.Args() {
+		res := util.ResolveHost(util.Cfg.GeoIPEndpoint, host)
+		if res.Err != nil || len(res.Infos()) == 0 {
+			failed = true
+		}
+		if *jsonOut {
+			results = append(results, newHostResult(res))
+		} else {
+			printResolution(res)
+		}
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write results: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/sociam/xray-archiver/pipeline/db"
+	"github.com/sociam/xray-archiver/pipeline/util"
+)
+
+// defaultHostCacheSize is the default for the -cache-size flag.
+const defaultHostCacheSize = 10000
+
+// hostCache is an LRU cache of the companies hosts were mapped to, so hosts
+// shared by many apps are only looked up once per run. Hosts that weren't
+// mapped to any company are cached too. Since companies may depend on the
+// locale they were looked up for, hosts are cached separately per locale.
+type hostCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	entries    map[string]*list.Element
+}
+
+type hostCacheEntry struct {
+	key       string
+	companies []db.TrackerMapperCompany
+}
+
+// hostCacheKey returns the key host is cached under for locale.
+func hostCacheKey(host, locale string) string {
+	return locale + "\x00" + host
+}
+
+// newHostCache returns a cache holding up to maxEntries hosts.
+func newHostCache(maxEntries int) *hostCache {
+	return &hostCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// lookup returns the cached companies of hosts for locale, along with the
+// hosts that aren't cached.
+func (c *hostCache) lookup(hosts []string, locale string) ([]db.TrackerMapperCompany, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var companies []db.TrackerMapperCompany
+	var missing []string
+	for _, host := range hosts {
+		elem, ok := c.entries[hostCacheKey(host, locale)]
+		if !ok {
+			missing = append(missing, host)
+			continue
+		}
+		c.ll.MoveToFront(elem)
+		companies = append(companies, elem.Value.(*hostCacheEntry).companies...)
+	}
+	return companies, missing
+}
+
+// add caches the companies the normalized hosts were mapped to by a single
+// Lookup for locale, evicting the least recently used hosts if the cache is
+// full. Companies are matched to hosts by their normalized HostName.
+func (c *hostCache) add(hosts []string, locale string, companies []db.TrackerMapperCompany) {
+	byHost := make(map[string][]db.TrackerMapperCompany, len(hosts))
+	for _, company := range companies {
+		host := util.NormalizeHost(company.HostName)
+		byHost[host] = append(byHost[host], company)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, host := range hosts {
+		key := hostCacheKey(host, locale)
+		if elem, ok := c.entries[key]; ok {
+			elem.Value.(*hostCacheEntry).companies = byHost[host]
+			c.ll.MoveToFront(elem)
+			continue
+		}
+		c.entries[key] = c.ll.PushFront(&hostCacheEntry{key, byHost[host]})
+	}
+	for c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*hostCacheEntry).key)
+	}
+}
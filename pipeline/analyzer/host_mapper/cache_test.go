@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sociam/xray-archiver/pipeline/db"
+)
+
+// cachedCompanies returns the names of the companies c holds for hosts, and
+// the hosts it doesn't hold.
+func cachedCompanies(c *hostCache, hosts []string, locale string) string {
+	companies, missing := c.lookup(hosts, locale)
+	var names []string
+	for _, company := range companies {
+		names = append(names, company.CompanyName)
+	}
+	return fmt.Sprint(names, missing)
+}
+
+func TestHostCacheEviction(t *testing.T) {
+	c := newHostCache(2)
+	c.add([]string{"a.com", "b.com"}, "", []db.TrackerMapperCompany{
+		{HostName: "a.com", CompanyName: "A"},
+		{HostName: "www.B.com", CompanyName: "B"},
+	})
+	if got := cachedCompanies(c, []string{"a.com", "b.com"}, ""); got != "[A B] []" {
+		t.Errorf("Got %s, expected both hosts to be cached", got)
+	}
+
+	// a.com was used more recently, so b.com is evicted to make room for
+	// c.com, which is cached even though it has no companies.
+	c.lookup([]string{"a.com"}, "")
+	c.add([]string{"c.com"}, "", nil)
+	if got := cachedCompanies(c, []string{"a.com", "b.com", "c.com"}, ""); got != "[A] [b.com]" {
+		t.Errorf("Got %s, expected b.com to be evicted", got)
+	}
+	if c.ll.Len() != 2 || len(c.entries) != 2 {
+		t.Errorf("Expected the cache to hold 2 hosts, got %d and %d", c.ll.Len(), len(c.entries))
+	}
+
+	// Adding a cached host again replaces its companies without growing
+	// the cache.
+	c.add([]string{"a.com"}, "", []db.TrackerMapperCompany{{HostName: "a.com", CompanyName: "A2"}})
+	if got := cachedCompanies(c, []string{"a.com", "c.com"}, ""); got != "[A2] []" || len(c.entries) != 2 {
+		t.Errorf("Got %s with %d entries, expected a.com to be updated", got, len(c.entries))
+	}
+}
+
+func TestHostCacheLocales(t *testing.T) {
+	c := newHostCache(10)
+	c.add([]string{"tracker.com"}, "us", []db.TrackerMapperCompany{{HostName: "tracker.com", CompanyName: "Tracker US"}})
+	c.add([]string{"tracker.com"}, "de", []db.TrackerMapperCompany{{HostName: "tracker.com", CompanyName: "Tracker DE"}})
+
+	for _, test := range []struct {
+		locale   string
+		expected string
+	}{
+		{"us", "[Tracker US] []"},
+		{"de", "[Tracker DE] []"},
+		{"", "[] [tracker.com]"},
+		{"fr", "[] [tracker.com]"},
+	} {
+		if got := cachedCompanies(c, []string{"tracker.com"}, test.locale); got != test.expected {
+			t.Errorf("Got %s for locale %q, expected %s", got, test.locale, test.expected)
+		}
+	}
+}
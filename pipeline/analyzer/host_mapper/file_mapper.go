@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sociam/xray-archiver/pipeline/db"
+	"github.com/sociam/xray-archiver/pipeline/util"
+)
+
+// FileTrackerMapper is a TrackerMapper using rules loaded from a local file,
+// for deployments without a TrackerMapper service. Each rule maps a host
+// pattern to a company: either an exact host name, or "*.<suffix>", which
+// matches suffix and any of its subdomains (hosts are normalized with
+// util.NormalizeHost, so "www.<suffix>" is looked up as suffix). A host
+// matching an exact rule is never mapped by a suffix rule, and longer
+// suffixes take precedence over shorter ones.
+type FileTrackerMapper struct {
+	exact  map[string]db.TrackerMapperCompany
+	suffix map[string]db.TrackerMapperCompany
+}
+
+// LoadFileTrackerMapper loads the rules in the file at path. Files ending in
+// .csv are read as CSV with a header row naming the columns hostName,
+// companyName and optionally companyID, locale and categories (separated by
+// ";"). Other files are read as a JSON array of objects with the same keys as
+// a TrackerMapper API response, with the pattern in hostName.
+func LoadFileTrackerMapper(path string) (*FileTrackerMapper, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open TrackerMapper rules %s: %s", path, err.Error())
+	}
+	defer f.Close()
+
+	var rules []db.TrackerMapperCompany
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		rules, err = readCSVRules(f)
+	} else {
+		err = json.NewDecoder(f).Decode(&rules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read TrackerMapper rules %s: %s", path, err.Error())
+	}
+
+	m := &FileTrackerMapper{
+		exact:  make(map[string]db.TrackerMapperCompany),
+		suffix: make(map[string]db.TrackerMapperCompany),
+	}
+	for _, rule := range rules {
+		if rule.CompanyName == "" {
+			return nil, fmt.Errorf("TrackerMapper rule for %s in %s has no company", rule.HostName, path)
+		}
+		if strings.HasPrefix(rule.HostName, "*.") {
+			m.suffix[util.NormalizeHost(rule.HostName[2:])] = rule
+		} else {
+			m.exact[util.NormalizeHost(rule.HostName)] = rule
+		}
+	}
+	return m, nil
+}
+
+// readCSVRules reads rules from a CSV file with a header row.
+func readCSVRules(r io.Reader) ([]db.TrackerMapperCompany, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	cols := make(map[string]int)
+	for i, name := range records[0] {
+		cols[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"hostName", "companyName"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("missing %s column", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		i, ok := cols[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	rules := make([]db.TrackerMapperCompany, 0, len(records)-1)
+	for line, record := range records[1:] {
+		rule := db.TrackerMapperCompany{
+			HostName:    field(record, "hostName"),
+			CompanyName: field(record, "companyName"),
+			Locale:      field(record, "locale"),
+		}
+		if id := field(record, "companyID"); id != "" {
+			rule.CompanyID, err = strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid companyID %s", line+2, id)
+			}
+		}
+		if categories := field(record, "categories"); categories != "" {
+			rule.Categories = strings.Split(categories, ";")
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Lookup implements TrackerMapper. Hosts that don't match any rule are left
+// out of the result. Rules don't depend on the locale, so it is ignored.
+func (m *FileTrackerMapper) Lookup(ctx context.Context, hosts []string, locale string) ([]db.TrackerMapperCompany, error) {
+	var tmCompanies []db.TrackerMapperCompany
+	for _, host := range hosts {
+		if rule, ok := m.match(util.NormalizeHost(host)); ok {
+			rule.HostName = host
+			tmCompanies = append(tmCompanies, rule)
+		}
+	}
+	return tmCompanies, nil
+}
+
+// match returns the rule host matches, if any.
+func (m *FileTrackerMapper) match(host string) (db.TrackerMapperCompany, bool) {
+	if rule, ok := m.exact[host]; ok {
+		return rule, true
+	}
+	for {
+		if rule, ok := m.suffix[host]; ok {
+			return rule, true
+		}
+		i := strings.Index(host, ".")
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return db.TrackerMapperCompany{}, false
+}
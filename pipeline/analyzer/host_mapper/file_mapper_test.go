@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// writeRules writes the rules file name to dir, returning its path.
+func writeRules(t *testing.T, dir, name, content string) string {
+	fname := path.Join(dir, name)
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestFileTrackerMapperMatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xray-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := LoadFileTrackerMapper(writeRules(t, dir, "rules.json", `[
+		{"hostName": "*.facebook.com", "companyName": "Facebook"},
+		{"hostName": "*.ads.facebook.com", "companyName": "Facebook Ads"},
+		{"hostName": "graph.ads.facebook.com", "companyName": "Facebook Graph"},
+		{"hostName": "google-analytics.com", "companyName": "Google"}
+	]`))
+	if err != nil {
+		t.Fatalf("LoadFileTrackerMapper failed: %s", err.Error())
+	}
+
+	for _, test := range []struct {
+		host    string
+		company string
+	}{
+		// Exact rules take precedence over suffix rules.
+		{"graph.ads.facebook.com", "Facebook Graph"},
+		// The longest suffix wins.
+		{"x.ads.facebook.com", "Facebook Ads"},
+		{"ads.facebook.com", "Facebook Ads"},
+		{"m.facebook.com", "Facebook"},
+		// A suffix rule matches the suffix itself, and www is normalized away.
+		{"facebook.com", "Facebook"},
+		{"www.Google-Analytics.com", "Google"},
+		// Exact rules don't match subdomains, or similar names.
+		{"ssl.google-analytics.com", ""},
+		{"notfacebook.com", ""},
+		{"com", ""},
+	} {
+		tmCompanies, err := m.Lookup(context.Background(), []string{test.host}, "us")
+		if err != nil {
+			t.Fatalf("Lookup failed: %s", err.Error())
+		}
+		var company string
+		if len(tmCompanies) > 0 {
+			company = tmCompanies[0].CompanyName
+			if tmCompanies[0].HostName != test.host {
+				t.Errorf("Expected the result for %s to have its host name, got %s", test.host, tmCompanies[0].HostName)
+			}
+		}
+		if len(tmCompanies) > 1 || company != test.company {
+			t.Errorf("Got %v for %s, expected %q", tmCompanies, test.host, test.company)
+		}
+	}
+}
+
+func TestLoadFileTrackerMapper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xray-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := writeRules(t, dir, "rules.csv", "hostName, companyName,companyID,categories\n"+
+		"*.doubleclick.net,Google,42,ads;analytics\n"+
+		"flurry.com , Flurry,,\n")
+	m, err := LoadFileTrackerMapper(fname)
+	if err != nil {
+		t.Fatalf("LoadFileTrackerMapper failed: %s", err.Error())
+	}
+	tmCompanies, _ := m.Lookup(context.Background(), []string{"ad.doubleclick.net", "flurry.com"}, "")
+	var got []string
+	for _, c := range tmCompanies {
+		got = append(got, fmt.Sprintf("%s:%s/%d%v", c.HostName, c.CompanyName, c.CompanyID, c.Categories))
+	}
+	if expected := "[ad.doubleclick.net:Google/42[ads analytics] flurry.com:Flurry/0[]]"; fmt.Sprint(got) != expected {
+		t.Errorf("Got %v from the CSV rules, expected %s", got, expected)
+	}
+
+	for _, test := range []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"bad-id.csv", "hostName,companyName,companyID\nflurry.com,Flurry,x\n", "line 2: invalid companyID x"},
+		{"no-company.csv", "hostName,companyID\nflurry.com,1\n", "missing companyName column"},
+		{"short-row.csv", "hostName,companyName\nflurry.com\n", "wrong number of fields"},
+		{"empty-company.csv", "hostName,companyName\nflurry.com,\n", "rule for flurry.com"},
+		{"bad.json", `[{"hostName": "flurry.com", "companyName": "Flurry"}`, "couldn't read TrackerMapper rules"},
+		{"empty-company.json", `[{"hostName": "flurry.com"}]`, "rule for flurry.com"},
+		{"missing.json", "", "couldn't open TrackerMapper rules"},
+	} {
+		fname := path.Join(dir, test.name)
+		if test.content != "" {
+			fname = writeRules(t, dir, test.name, test.content)
+		}
+		if _, err := LoadFileTrackerMapper(fname); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected an error containing %q for %s, got %v", test.err, test.name, err)
+		}
+	}
+}
@@ -1,75 +1,422 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/sociam/xray-archiver/pipeline/db"
 	"github.com/sociam/xray-archiver/pipeline/util"
 )
 
-func requestTrackerMapping(appHostRecord db.AppHostRecord) []db.TrackerMapperCompany {
-	tmReqData := db.TrackerMapperRequest{appHostRecord.HostNames}
-	// BODY: {"host_names":["facebook.com", "360.jp.co"]}
-	// URL: localhost:8080/hosts
-	// REQUEST TYPE: Post
+// normalizeHosts normalizes host names with util.NormalizeHost, then removes
+// the duplicates this leaves, so that e.g. "www.Facebook.com." and
+// "facebook.com" are only mapped once.
+func normalizeHosts(hosts []string) []string {
+	ret := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		if host = util.NormalizeHost(host); host != "" {
+			ret = append(ret, host)
+		}
+	}
+	return util.Dedup(ret)
+}
+
+var cfgFile = flag.String("cfg", "/etc/xray/config.json", "config file location")
+var dryRun = flag.Bool("dry-run", false, "map hosts and log what would be written without writing to the database")
+var workers = flag.Int("workers", 0, "number of apps mapped at once (default tracker_mapper.workers)")
+var cacheSize = flag.Int("cache-size", defaultHostCacheSize, "number of hosts whose companies are cached during a run, or 0 to look every host up for each app")
+var outFile = flag.String("out", "", "append the results to this file as newline delimited JSON, one {appID, companies} object per app, instead of writing them to the database")
+var resume = flag.Bool("resume", false, "skip apps already mapped within -resume-window")
+var resumeWindow = flag.Duration("resume-window", 7*24*time.Hour, "how recently an app must have been mapped to be skipped with -resume")
+var progressEvery = flag.Int64("progress-every", 0, "log the progress of a run after every this many apps, or 0 to only log it on -progress-interval")
+var progressInterval = flag.Duration("progress-interval", time.Minute, "how often to log the progress of a run, or 0 to only log it on -progress-every")
 
-	url := "http://127.0.0.1:8080/hosts" // Get from some config file or something...
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] [command]
 
-	// Encode Object
-	ioBuffer := new(bytes.Buffer)
-	json.NewEncoder(ioBuffer).Encode(tmReqData)
+Commands:
+  run [-workers n] [-dry-run] [-cache-size n] [-out file]
+      [-resume] [-resume-window d] [-progress-every n] [-progress-interval d]
+            map the hosts of every app (the default)
+  map [-locale region] host...
+            map the given hosts and print their companies
+  stats     count the apps that aren't mapped to any company
 
-	// Form Request and set headers.
-	req, err := http.NewRequest("POST", url, ioBuffer)
-	req.Header.Set("Content-Type", "application/json")
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
 
-	// Check for errors forming request.
+// setup parses the flags, loads the config and opens the database.
+func setup() {
+	var err error
+	flag.Usage = usage
+	flag.Parse()
+	err = util.LoadCfg(*cfgFile, util.Analyzer)
+	if err != nil {
+		log.Fatalf("Failed to read config: %s", err.Error())
+	}
+	err = db.OpenWithRetry(util.Cfg, util.Cfg.DB.ConnectWait)
 	if err != nil {
-		util.Log.Err("Error forming TrackerMapper API Request.", err)
+		log.Fatalf("Failed to open a connection to the database: %s", err.Error())
 	}
+}
 
-	// carry out the request.
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// startHealthServer starts the health server if health.addr is configured.
+func startHealthServer() error {
+	if util.Cfg.Health.Addr == "" {
+		return nil
+	}
 
-	// check for errors carrying out the request
-	if err != nil {
-		util.Log.Err("Client Error issueing Tracker Mapper API request..", err)
+	util.AddReadinessCheck("db", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return db.Ping(ctx)
+	})
+	if util.Cfg.Health.CheckServices && util.Cfg.TrackerMapper.Backend == util.TrackerMapperBackendHTTP {
+		util.AddReadinessCheck("tracker_mapper", util.CheckReachable(util.Cfg.TrackerMapper.URL))
 	}
+	return util.StartHealthServer(util.Cfg.Health.Addr)
+}
+
+// idPageSize is the number of app IDs fetched from the database at once.
+const idPageSize = 1000
+
+// dryRunSummary counts what a dry run would have written to the database.
+type dryRunSummary struct {
+	apps      int
+	companies map[string]util.Unit
+	assocs    int
+}
+
+// appResult is the line written to the -out file for each app, listing the
+// companies its hosts were mapped to.
+type appResult struct {
+	AppID     int64        `json:"appID"`
+	Companies []appCompany `json:"companies"`
+}
+
+// appCompany is a company of an appResult, along with the host that tied it
+// to the app.
+type appCompany struct {
+	Host      string `json:"host"`
+	Company   string `json:"company"`
+	CompanyID int64  `json:"companyID"`
+	Locale    string `json:"locale"`
+}
 
-	// Check there is a response body.
-	if resp.Body != nil {
-		defer resp.Body.Close()
+// mapRun holds the state shared by the workers of a run.
+type mapRun struct {
+	mapper  TrackerMapper
+	store   mapStore
+	limiter *rateLimiter
+	// cache holds the companies of hosts already looked up, unless it is
+	// disabled with -cache-size 0.
+	cache *hostCache
+	// dbMu serializes database writes, since InsertCompanyName and
+	// InsertCompanyAppAssociation check before inserting, as well as writes
+	// to out and summary.
+	dbMu    sync.Mutex
+	out     io.Writer
+	summary dryRunSummary
+	// insertedNames and insertedCompanies hold the company names and the
+	// companies, by companyKey, already inserted during the run, so that each
+	// is only written once however many apps it is associated with. They are
+	// guarded by dbMu.
+	insertedNames     map[string]util.Unit
+	insertedCompanies map[string]util.Unit
+}
+
+// companyKey identifies a company by its name and locale, which companies
+// are unique by in the database.
+func companyKey(c db.TrackerMapperCompany) string {
+	return c.CompanyName + "\x00" + c.Locale
+}
+
+// processApp maps the hosts of the app with the given ID to companies and
+// records them in the database, or in r.out if it is set. In a dry run, the
+// writes are only logged and counted in r.summary. Apps whose companies and
+// associations are all written to the database are marked as mapped, for
+// -resume. It reports whether the app was processed, which it isn't if ctx
+// is done before its hosts are mapped.
+func (r *mapRun) processApp(ctx context.Context, appID int64) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	appHostRecord, err := r.store.GetAppHosts(ctx, appID)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		util.Log.Err("Failed to get hosts of app %d: %s", appID, err.Error())
+		return true
+	}
+	if len(appHostRecord.HostNames) == 0 {
+		if !*dryRun && r.out == nil {
+			r.setMapped(appID)
+		}
+		return true
 	}
 
-	// Decode the response and check for error.
+	hosts := normalizeHosts(appHostRecord.HostNames)
 	var tmCompanies []db.TrackerMapperCompany
-	if err := json.NewDecoder(resp.Body).Decode(&tmCompanies); err != nil {
-		util.Log.Err("Error Decoding Response Body from TrackerMapper API.", err)
+	if r.cache != nil {
+		var missing []string
+		tmCompanies, missing = r.cache.lookup(hosts, appHostRecord.Region)
+		hostCacheHits.Add(float64(len(hosts) - len(missing)))
+		hosts = missing
+	}
+
+	// All of an app's uncached hosts are mapped in a single request.
+	if len(hosts) > 0 {
+		if err := r.limiter.Wait(ctx); err != nil {
+			return false
+		}
+		start := time.Now()
+		looked, err := r.mapper.Lookup(ctx, hosts, appHostRecord.Region)
+		trackerMapperLatency.Observe(time.Since(start).Seconds())
+		hostsLookedUp.Add(float64(len(hosts)))
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			trackerMapperErrors.Inc()
+			util.Log.Err("Failed to map hosts of app %d: %s", appID, err.Error())
+			return true
+		}
+		if r.cache != nil {
+			r.cache.add(hosts, appHostRecord.Region, looked)
+		}
+		tmCompanies = append(tmCompanies, looked...)
+	}
+
+	r.dbMu.Lock()
+	defer r.dbMu.Unlock()
+
+	if *dryRun {
+		r.summary.apps++
+		for _, c := range tmCompanies {
+			r.summary.companies[companyKey(c)] = util.Unit{}
+			r.summary.assocs++
+			util.Log.Info("Would associate app %d with company %s (locale %q) via host %s",
+				appID, c.CompanyName, c.Locale, c.HostName)
+		}
+		return true
+	}
+
+	if r.out != nil {
+		res := appResult{AppID: appID, Companies: make([]appCompany, 0, len(tmCompanies))}
+		for _, c := range tmCompanies {
+			res.Companies = append(res.Companies, appCompany{
+				Host:      c.HostName,
+				Company:   c.CompanyName,
+				CompanyID: c.CompanyID,
+				Locale:    c.Locale,
+			})
+		}
+		if err := util.WriteJSON(r.out, res); err != nil {
+			util.Log.Err("Failed to write results of app %d: %s", appID, err.Error())
+		}
+		return true
+	}
+
+	assocs := make([]db.AppTrackerCompany, 0, len(tmCompanies))
+	var newCompanies []db.TrackerMapperCompany
+	// assocFailed is set if an association couldn't be inserted, so that the
+	// app isn't marked as mapped and is mapped again by a -resume run.
+	assocFailed := false
+	for j := 0; j < len(tmCompanies); j++ {
+		// Insert Company App Association into the Database, inserting the
+		// company first unless it already was during this run.
+		name := tmCompanies[j].CompanyName
+		if _, ok := r.insertedNames[name]; !ok && r.store.InsertCompanyName(name) == nil {
+			r.insertedNames[name] = util.Unit{}
+		}
+		if err := r.store.InsertCompanyAppAssociation(appID, name); err != nil {
+			util.Log.Err("Failed to associate app %d with company %s: %s", appID, name, err.Error())
+			assocFailed = true
+		}
+		if _, ok := r.insertedCompanies[companyKey(tmCompanies[j])]; !ok {
+			newCompanies = append(newCompanies, tmCompanies[j])
+			r.insertedCompanies[companyKey(tmCompanies[j])] = util.Unit{}
+		}
+
+		// Record the company along with the host that tied it to the app.
+		assocs = append(assocs, db.AppTrackerCompany{
+			AppID:  appID,
+			Name:   tmCompanies[j].CompanyName,
+			Locale: tmCompanies[j].Locale,
+			Host:   tmCompanies[j].HostName,
+		})
+
+		util.Log.Debug("Company Name: %s, Host Name: %s", tmCompanies[j].CompanyName, tmCompanies[j].HostName)
+	}
+
+	if err := r.store.BatchInsertCompanies(newCompanies); err != nil {
+		// Let a later app insert them again.
+		for _, c := range newCompanies {
+			delete(r.insertedCompanies, companyKey(c))
+		}
+		util.Log.Err("Failed to insert companies of app %d, writing them one at a time: %s", appID, err.Error())
+		if r.writeCompanies(appID, tmCompanies) && !assocFailed {
+			r.setMapped(appID)
+		}
+		return true
+	}
+	companiesInserted.Add(float64(len(newCompanies)))
+	if err := r.store.BatchAddAppCompanies(assocs); err != nil {
+		util.Log.Err("Failed to associate app %d with its companies, writing them one at a time: %s",
+			appID, err.Error())
+		if r.writeCompanies(appID, tmCompanies) && !assocFailed {
+			r.setMapped(appID)
+		}
+		return true
+	}
+	if !assocFailed {
+		r.setMapped(appID)
 	}
-	return tmCompanies
+	return true
 }
 
-var cfgFile = flag.String("cfg", "/etc/xray/config.json", "config file location")
+// writeCompanies writes the given companies of the app with the given ID and
+// their associations with it a row at a time, for when writing them in a batch
+// failed, so that one bad row doesn't keep the rest out of the database. It
+// reports whether every row was written. r.dbMu must be held.
+func (r *mapRun) writeCompanies(appID int64, companies []db.TrackerMapperCompany) bool {
+	ok := true
+	for _, c := range companies {
+		id, err := r.store.InsertCompany(c)
+		if err != nil {
+			util.Log.Err("Failed to insert company %s (locale %q): %s", c.CompanyName, c.Locale, err.Error())
+			ok = false
+			continue
+		}
+		if _, inserted := r.insertedCompanies[companyKey(c)]; !inserted {
+			r.insertedCompanies[companyKey(c)] = util.Unit{}
+			companiesInserted.Inc()
+		}
+		if err := r.store.AddAppCompany(appID, id, c.HostName); err != nil {
+			util.Log.Err("Failed to associate app %d with company %s via host %s: %s",
+				appID, c.CompanyName, c.HostName, err.Error())
+			ok = false
+		}
+	}
+	return ok
+}
 
-func init() {
-	var err error
-	flag.Parse()
-	err = util.LoadCfg(*cfgFile, util.Analyzer)
-	if err != nil {
-		log.Fatalf("Failed to read config: %s", err.Error())
+// setMapped marks the app with the given ID as mapped.
+func (r *mapRun) setMapped(appID int64) {
+	if err := r.store.SetAppMapped(appID); err != nil {
+		util.Log.Err("Failed to mark app %d as mapped: %s", appID, err.Error())
 	}
-	err = db.Open(util.Cfg, true)
-	if err != nil {
-		log.Fatalf("Failed to open a connection to the database: %s", err.Error())
+}
+
+// mapApps maps the apps with hosts with n workers, skipping those in skip,
+// and returns the number of apps processed. The app IDs are streamed a page
+// at a time rather than loaded all at once. It stops between apps when ctx is
+// done, and calls progress.Add after each app processed; apps skipped because
+// ctx is done aren't counted.
+func (r *mapRun) mapApps(ctx context.Context, n int, skip map[int64]util.Unit, progress *progressReporter) int64 {
+	var wg sync.WaitGroup
+	var processed int64
+	jobs := make(chan int64)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for appID := range jobs {
+				if !r.processApp(ctx, appID) {
+					continue
+				}
+				atomic.AddInt64(&processed, 1)
+				progress.Add()
+				appsProcessed.Inc()
+			}
+		}()
+	}
+
+feed:
+	for offset := 0; ; offset += idPageSize {
+		appIDs, err := r.store.GetAppHostIDsPaged(ctx, offset, idPageSize)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			util.Log.Err("Failed to get app IDs: %s", err.Error())
+			break
+		}
+		for _, appID := range appIDs {
+			if _, ok := skip[appID]; ok {
+				continue
+			}
+			select {
+			case jobs <- appID:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		if len(appIDs) < idPageSize {
+			break
+		}
 	}
+	close(jobs)
+	wg.Wait()
+	return processed
 }
 
-func main() {
+// runCmd maps the hosts of every app to companies. The -workers, -dry-run,
+// -cache-size, -out, -resume, -resume-window, -progress-every and
+// -progress-interval flags may be given either before or after the command.
+//
+// The number of apps processed, the rate they're processed at and an estimate
+// of when the run will finish are logged after every -progress-every apps and
+// every -progress-interval.
+//
+// Every app mapped into the database is marked as mapped, so that if a run is
+// interrupted, running again with -resume only maps the apps it didn't get
+// to. Since the associations are only inserted if they don't exist yet, an app
+// that was mapped without being marked is simply mapped again.
+func runCmd(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.IntVar(workers, "workers", *workers, "number of apps mapped at once (default tracker_mapper.workers)")
+	fs.BoolVar(dryRun, "dry-run", *dryRun, "map hosts and log what would be written without writing to the database")
+	fs.IntVar(cacheSize, "cache-size", *cacheSize, "number of hosts whose companies are cached during a run, or 0 to look every host up for each app")
+	fs.StringVar(outFile, "out", *outFile, "append the results to this file as newline delimited JSON, one {appID, companies} object per app, instead of writing them to the database")
+	fs.BoolVar(resume, "resume", *resume, "skip apps already mapped within -resume-window")
+	fs.DurationVar(resumeWindow, "resume-window", *resumeWindow, "how recently an app must have been mapped to be skipped with -resume")
+	fs.Int64Var(progressEvery, "progress-every", *progressEvery, "log the progress of a run after every this many apps, or 0 to only log it on -progress-interval")
+	fs.DurationVar(progressInterval, "progress-interval", *progressInterval, "how often to log the progress of a run, or 0 to only log it on -progress-every")
+	fs.Parse(args)
+
+	var mapped map[int64]util.Unit
+	if *resume {
+		var err error
+		mapped, err = db.GetAppsMappedSince(time.Now().Add(-*resumeWindow))
+		if err != nil {
+			return fmt.Errorf("couldn't get the apps already mapped: %s", err.Error())
+		}
+		util.Log.Info("Resuming: skipping %d apps mapped in the last %s", len(mapped), *resumeWindow)
+	}
+
+	if err := startHealthServer(); err != nil {
+		return err
+	}
+	if util.Cfg.MetricsAddr != "" {
+		if err := util.StartMetricsServer(util.Cfg.MetricsAddr); err != nil {
+			return err
+		}
+	}
+
 	// Select app Host app IDs.
 	// for all app_host records
 	// for all hosts in app host_records
@@ -77,19 +424,142 @@ func main() {
 	// insert company if new
 	// insert company app association if new.
 
-	appIDs, _ := db.GetAppHostIDs()
+	// Stop between apps on SIGINT or SIGTERM, so that an app's companies are
+	// never left half-written. Queries reading the apps to map and
+	// TrackerMapper requests are cancelled, but an app's writes aren't.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Once interrupted, stop catching the signals, so that a second Ctrl-C
+	// kills the process if finishing the apps in progress takes too long.
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	for i := 0; i < len(appIDs); i++ {
-		appHostRecord, _ := db.GetAppHostsByID(appIDs[i])
+	mapper, err := newTrackerMapper()
+	if err != nil {
+		return err
+	}
 
-		tmCompanies := requestTrackerMapping(appHostRecord)
+	n := *workers
+	if n <= 0 {
+		n = util.Cfg.TrackerMapper.Workers
+	}
+	run := &mapRun{
+		mapper:  mapper,
+		store:   dbStore{},
+		limiter: newRateLimiter(ctx, util.Cfg.TrackerMapper.RateLimit, n),
+		summary: dryRunSummary{companies: make(map[string]util.Unit)},
 
-		for j := 0; j < len(tmCompanies); j++ {
-			// Insert Company App Association into the Database.
-			db.InsertCompanyName(tmCompanies[j].CompanyName)
-			db.InsertCompanyAppAssociation(appIDs[i], tmCompanies[j].CompanyName)
+		insertedNames:     make(map[string]util.Unit),
+		insertedCompanies: make(map[string]util.Unit),
+	}
+	if *cacheSize > 0 {
+		run.cache = newHostCache(*cacheSize)
+	}
 
-			util.Log.Debug("Company Name: %s, Host Name: %s", tmCompanies[j].CompanyName, tmCompanies[j].HostName)
+	if *outFile != "" {
+		f, err := os.OpenFile(*outFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("couldn't open output file: %s", err.Error())
 		}
+		defer f.Close()
+		run.out = f
+	}
+
+	// The total is only used for progress reports, so the run goes ahead
+	// without one if it can't be counted.
+	total, _, err := db.CountUnmappedAppsContext(ctx)
+	if err != nil {
+		util.Log.Warning("Couldn't count the apps to map: %s", err.Error())
+		total = 0
+	} else if total -= int64(len(mapped)); total < 0 {
+		total = 0
+	}
+	progress := newProgressReporter(total, *progressEvery, *progressInterval)
+	defer progress.Stop()
+
+	processed := run.mapApps(ctx, n, mapped, progress)
+
+	if *dryRun {
+		util.Log.Info("Dry run: %d apps mapped, %d unique companies seen, %d associations would be created",
+			run.summary.apps, len(run.summary.companies), run.summary.assocs)
+	}
+	if ctx.Err() != nil {
+		util.Log.Info("Interrupted after processing %d apps", processed)
+		return nil
+	}
+	util.Log.Info("Processed %d apps", processed)
+	return nil
+}
+
+// mapCmd maps the hosts given as arguments and prints the companies they are
+// mapped to, without touching the database.
+func mapCmd(args []string) error {
+	fs := flag.NewFlagSet("map", flag.ExitOnError)
+	locale := fs.String("locale", "", "region of the app the hosts belong to, e.g. us")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("usage: host_mapper map [-locale region] host...")
+	}
+
+	mapper, err := newTrackerMapper()
+	if err != nil {
+		return err
+	}
+	tmCompanies, err := mapper.Lookup(context.Background(), normalizeHosts(fs.Args()), *locale)
+	if err != nil {
+		return err
+	}
+	if len(tmCompanies) == 0 {
+		fmt.Println("No companies found")
+	}
+	for _, c := range tmCompanies {
+		fmt.Printf("%s: %s (locale %q, categories %v)\n", c.HostName, c.CompanyName, c.Locale, c.Categories)
+	}
+	return nil
+}
+
+// statsCmd prints how many apps with hosts aren't mapped to any company.
+func statsCmd(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	fs.Parse(args)
+
+	total, unmapped, err := db.CountUnmappedApps()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d of %d apps with hosts have no company mappings\n", unmapped, total)
+	return nil
+}
+
+func main() {
+	setup()
+	cmd, args := "run", flag.Args()
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	var err error
+	switch cmd {
+	case "run":
+		err = runCmd(args)
+	case "map":
+		err = mapCmd(args)
+	case "stats":
+		err = statsCmd(args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", cmd)
+		flag.Usage()
+		db.Close()
+		os.Exit(64)
+	}
+
+	// Close the database before exiting, as log.Fatal skips deferred calls.
+	if closeErr := db.Close(); closeErr != nil {
+		util.Log.Err("Failed to close the database: %s", closeErr.Error())
+	}
+	if err != nil {
+		log.Fatal(err.Error())
 	}
 }
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/sociam/xray-archiver/pipeline/db"
+	"github.com/sociam/xray-archiver/pipeline/util"
+)
+
+// fakeMapper is a TrackerMapper mapping each host to the companies in
+// companies, recording the hosts it is asked about.
+type fakeMapper struct {
+	companies map[string][]db.TrackerMapperCompany
+
+	mu     sync.Mutex
+	looked []string
+}
+
+func (m *fakeMapper) Lookup(ctx context.Context, hosts []string, locale string) ([]db.TrackerMapperCompany, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var tmCompanies []db.TrackerMapperCompany
+	for _, host := range hosts {
+		m.looked = append(m.looked, host)
+		tmCompanies = append(tmCompanies, m.companies[host]...)
+	}
+	return tmCompanies, nil
+}
+
+// fakeStore is a mapStore holding the apps in apps, recording what is
+// written to it. Batch inserts of companies fail while failCompanies is set,
+// inserts of the company failCompany fail, and associations with the company
+// failAssoc fail.
+type fakeStore struct {
+	apps          map[int64]db.AppHostRecord
+	failCompanies bool
+	failCompany   string
+	failAssoc     string
+
+	mu        sync.Mutex
+	names     []string
+	assocs    []string
+	companies []string
+	edges     []string
+	mapped    []int64
+}
+
+func (s *fakeStore) GetAppHostIDsPaged(ctx context.Context, offset, limit int) ([]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for id := range s.apps {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if offset >= len(ids) {
+		return nil, nil
+	}
+	ids = ids[offset:]
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+func (s *fakeStore) GetAppHosts(ctx context.Context, appID int64) (db.AppHostRecord, error) {
+	app, ok := s.apps[appID]
+	if !ok {
+		return db.AppHostRecord{}, fmt.Errorf("no app %d", appID)
+	}
+	return app, nil
+}
+
+func (s *fakeStore) InsertCompanyName(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.names = append(s.names, name)
+	return nil
+}
+
+func (s *fakeStore) InsertCompanyAppAssociation(appID int64, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name == s.failAssoc {
+		return errors.New("association failed")
+	}
+	s.assocs = append(s.assocs, fmt.Sprintf("%d:%s", appID, name))
+	return nil
+}
+
+func (s *fakeStore) BatchInsertCompanies(companies []db.TrackerMapperCompany) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failCompanies {
+		return errors.New("insert failed")
+	}
+	for _, c := range companies {
+		s.companies = append(s.companies, c.CompanyName+"/"+c.Locale)
+	}
+	return nil
+}
+
+func (s *fakeStore) BatchAddAppCompanies(assocs []db.AppTrackerCompany) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range assocs {
+		s.edges = append(s.edges, fmt.Sprintf("%d:%s/%s:%s", a.AppID, a.Name, a.Locale, a.Host))
+	}
+	return nil
+}
+
+func (s *fakeStore) InsertCompany(company db.TrackerMapperCompany) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if company.CompanyName == s.failCompany {
+		return 0, errors.New("insert failed")
+	}
+	s.companies = append(s.companies, company.CompanyName+"/"+company.Locale)
+	return int64(len(s.companies)), nil
+}
+
+func (s *fakeStore) AddAppCompany(appID, companyID int64, host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.edges = append(s.edges, fmt.Sprintf("%d:%s:%s", appID, s.companies[companyID-1], host))
+	return nil
+}
+
+func (s *fakeStore) SetAppMapped(appID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mapped = append(s.mapped, appID)
+	return nil
+}
+
+// newTestRun returns a mapRun of the fake mapper and store, with a host cache
+// of cacheSize hosts, or none if it is 0.
+func newTestRun(mapper TrackerMapper, store mapStore, cacheSize int) *mapRun {
+	r := &mapRun{
+		mapper:            mapper,
+		store:             store,
+		summary:           dryRunSummary{companies: make(map[string]util.Unit)},
+		insertedNames:     make(map[string]util.Unit),
+		insertedCompanies: make(map[string]util.Unit),
+	}
+	if cacheSize > 0 {
+		r.cache = newHostCache(cacheSize)
+	}
+	return r
+}
+
+// testMapper maps the hosts of testApps.
+func testMapper() *fakeMapper {
+	return &fakeMapper{companies: map[string][]db.TrackerMapperCompany{
+		"tracker.com": {{HostName: "tracker.com", CompanyName: "Tracker", Locale: "us"}},
+		"ads.com":     {{HostName: "ads.com", CompanyName: "Ads", Locale: "us"}},
+	}}
+}
+
+// testApps are apps sharing the host tracker.com, one of them with no hosts.
+func testApps() map[int64]db.AppHostRecord {
+	return map[int64]db.AppHostRecord{
+		1: {ID: 1, HostNames: []string{"www.Tracker.com", "ads.com"}, Region: "us"},
+		2: {ID: 2, HostNames: []string{"tracker.com", "unknown.org"}, Region: "us"},
+		3: {ID: 3, Region: "us"},
+	}
+}
+
+func TestProcessApp(t *testing.T) {
+	mapper, store := testMapper(), &fakeStore{apps: testApps()}
+	r := newTestRun(mapper, store, 10)
+	for _, id := range []int64{1, 2, 3} {
+		r.processApp(context.Background(), id)
+	}
+
+	// Each company is only inserted once, but every association is recorded.
+	for _, test := range []struct {
+		name     string
+		got      interface{}
+		expected string
+	}{
+		{"company names", store.names, "[Tracker Ads]"},
+		{"companies", store.companies, "[Tracker/us Ads/us]"},
+		{"associations", store.assocs, "[1:Tracker 1:Ads 2:Tracker]"},
+		{"app companies", store.edges, "[1:Tracker/us:tracker.com 1:Ads/us:ads.com 2:Tracker/us:tracker.com]"},
+		{"mapped apps", store.mapped, "[1 2 3]"},
+		// tracker.com is cached after the first app.
+		{"lookups", mapper.looked, "[tracker.com ads.com unknown.org]"},
+	} {
+		if fmt.Sprint(test.got) != test.expected {
+			t.Errorf("Got %s %v, expected %s", test.name, test.got, test.expected)
+		}
+	}
+}
+
+func TestProcessAppBatchFallback(t *testing.T) {
+	store := &fakeStore{apps: testApps(), failCompanies: true}
+	r := newTestRun(testMapper(), store, 0)
+	r.processApp(context.Background(), 1)
+	// The companies are written one at a time instead.
+	if fmt.Sprint(store.companies) != "[Tracker/us Ads/us]" ||
+		fmt.Sprint(store.edges) != "[1:Tracker/us:tracker.com 1:Ads/us:ads.com]" ||
+		fmt.Sprint(store.mapped) != "[1]" {
+		t.Errorf("Expected app 1's companies to be written one at a time, got %v, %v, %v",
+			store.companies, store.edges, store.mapped)
+	}
+}
+
+func TestProcessAppInsertFailure(t *testing.T) {
+	store := &fakeStore{apps: testApps(), failCompanies: true, failCompany: "Ads"}
+	r := newTestRun(testMapper(), store, 0)
+	r.processApp(context.Background(), 1)
+	// Tracker is still written, but the app isn't marked as mapped.
+	if len(store.mapped) != 0 || fmt.Sprint(store.edges) != "[1:Tracker/us:tracker.com]" {
+		t.Errorf("Expected an app whose companies failed to insert not to be mapped, got %v, %v",
+			store.mapped, store.edges)
+	}
+
+	// Ads is inserted by the next app that has it.
+	store.failCompanies, store.failCompany = false, ""
+	r.processApp(context.Background(), 2)
+	r.processApp(context.Background(), 1)
+	if fmt.Sprint(store.companies) != "[Tracker/us Ads/us]" || fmt.Sprint(store.mapped) != "[2 1]" {
+		t.Errorf("Expected Ads to be inserted when app 1 is mapped again, got %v, %v", store.companies, store.mapped)
+	}
+}
+
+func TestProcessAppAssocFailure(t *testing.T) {
+	store := &fakeStore{apps: testApps(), failAssoc: "Ads"}
+	r := newTestRun(testMapper(), store, 0)
+	r.processApp(context.Background(), 1)
+	r.processApp(context.Background(), 2)
+	// App 1's other company is still written, but it isn't marked as mapped.
+	if fmt.Sprint(store.assocs) != "[1:Tracker 2:Tracker]" || fmt.Sprint(store.mapped) != "[2]" {
+		t.Errorf("Expected only app 2 to be mapped, got associations %v and mapped %v", store.assocs, store.mapped)
+	}
+}
+
+func TestProcessAppCancelled(t *testing.T) {
+	mapper, store := testMapper(), &fakeStore{apps: testApps()}
+	r := newTestRun(mapper, store, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if r.processApp(ctx, 1) || mapper.looked != nil || store.mapped != nil {
+		t.Errorf("Expected an app not to be processed once cancelled, got lookups %v and mapped %v",
+			mapper.looked, store.mapped)
+	}
+	if !r.processApp(context.Background(), 3) {
+		t.Errorf("Expected an app without hosts to be processed")
+	}
+}
+
+func TestProcessAppOut(t *testing.T) {
+	store := &fakeStore{apps: testApps()}
+	r := newTestRun(testMapper(), store, 0)
+	var out bytes.Buffer
+	r.out = &out
+	r.processApp(context.Background(), 1)
+	r.processApp(context.Background(), 2)
+
+	// Each app is written as a single line listing its companies.
+	expected := `{"appID":1,"companies":[{"host":"tracker.com","company":"Tracker","companyID":0,"locale":"us"},` +
+		`{"host":"ads.com","company":"Ads","companyID":0,"locale":"us"}]}
+{"appID":2,"companies":[{"host":"tracker.com","company":"Tracker","companyID":0,"locale":"us"}]}
+`
+	if out.String() != expected {
+		t.Errorf("Got output\n%s\nexpected\n%s", out.String(), expected)
+	}
+	if store.edges != nil || store.mapped != nil {
+		t.Errorf("Expected nothing to be written to the database with -out, got %+v", store)
+	}
+}
+
+func TestProcessAppDryRun(t *testing.T) {
+	defer func(v bool) { *dryRun = v }(*dryRun)
+	*dryRun = true
+
+	store := &fakeStore{apps: testApps()}
+	r := newTestRun(testMapper(), store, 0)
+	for _, id := range []int64{1, 2, 3} {
+		r.processApp(context.Background(), id)
+	}
+	if store.names != nil || store.assocs != nil || store.companies != nil || store.edges != nil || store.mapped != nil {
+		t.Errorf("Expected a dry run not to write anything, got %+v", store)
+	}
+	if r.summary.apps != 2 || len(r.summary.companies) != 2 || r.summary.assocs != 3 {
+		t.Errorf("Got summary of %d apps, %d companies and %d associations, expected 2, 2 and 3",
+			r.summary.apps, len(r.summary.companies), r.summary.assocs)
+	}
+}
+
+func TestMapAppsResume(t *testing.T) {
+	mapper, store := testMapper(), &fakeStore{apps: testApps()}
+	r := newTestRun(mapper, store, 0)
+	progress := newProgressReporter(0, 0, 0)
+	defer progress.Stop()
+
+	// App 1 was mapped by an earlier run, so only app 2's hosts are looked up.
+	processed := r.mapApps(context.Background(), 2, map[int64]util.Unit{1: {}}, progress)
+	sort.Slice(store.mapped, func(i, j int) bool { return store.mapped[i] < store.mapped[j] })
+	if processed != 2 || fmt.Sprint(store.mapped) != "[2 3]" {
+		t.Errorf("Got %d apps processed and %v mapped, expected 2 and [2 3]", processed, store.mapped)
+	}
+	if fmt.Sprint(mapper.looked) != "[tracker.com unknown.org]" {
+		t.Errorf("Expected only app 2's hosts to be looked up, got %v", mapper.looked)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if processed = r.mapApps(ctx, 2, nil, progress); processed != 0 {
+		t.Errorf("Expected no apps to be processed once cancelled, got %d", processed)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/sociam/xray-archiver/pipeline/db"
+	"github.com/sociam/xray-archiver/pipeline/util"
+)
+
+// TrackerMapper maps host names to the companies that own them. locale is the
+// region of the app the hosts were found in, e.g. "us", or empty if it isn't
+// known, and may be used to return locale specific company data. Lookup gives
+// up when ctx is done.
+type TrackerMapper interface {
+	Lookup(ctx context.Context, hosts []string, locale string) ([]db.TrackerMapperCompany, error)
+}
+
+// newTrackerMapper returns the TrackerMapper selected by
+// tracker_mapper.backend in the config.
+func newTrackerMapper() (TrackerMapper, error) {
+	if util.Cfg.TrackerMapper.Backend == util.TrackerMapperBackendFile {
+		return LoadFileTrackerMapper(util.Cfg.TrackerMapper.Path)
+	}
+	return &HTTPTrackerMapper{URL: util.Cfg.TrackerMapper.URL}, nil
+}
+
+// HTTPTrackerMapper is a TrackerMapper using the OxfordHCC TrackerMapper API
+// at URL. Client is used to make the requests, or the client used by GetJSON,
+// with the TLS settings of the config, if it is nil.
+type HTTPTrackerMapper struct {
+	URL    string
+	Client *http.Client
+}
+
+// Lookup issues a single TrackerMapper request containing every host name and
+// the locale, if any, and returns the companies the hosts were mapped to.
+func (m *HTTPTrackerMapper) Lookup(ctx context.Context, hosts []string, locale string) ([]db.TrackerMapperCompany, error) {
+	tmReqData := db.TrackerMapperRequest{HostNames: hosts, Locale: locale}
+	// BODY: {"host_names":["facebook.com", "360.jp.co"], "locale": "us"}
+	// URL: tracker_mapper.url from the config, http://localhost:8080/hosts by default
+	// REQUEST TYPE: Post
+
+	// Encode Object
+	ioBuffer := new(bytes.Buffer)
+	if err := json.NewEncoder(ioBuffer).Encode(tmReqData); err != nil {
+		return nil, fmt.Errorf("error encoding TrackerMapper API request: %s", err.Error())
+	}
+
+	// Form Request and set headers.
+	req, err := http.NewRequestWithContext(ctx, "POST", m.URL, ioBuffer)
+	if err != nil {
+		return nil, fmt.Errorf("error forming TrackerMapper API request: %s", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// carry out the request.
+	client := m.Client
+	if client == nil {
+		client = util.HTTPClient()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client error issuing TrackerMapper API request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	// Only decode successful responses.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrBodyLen))
+		return nil, fmt.Errorf("got status %d from TrackerMapper API: %s",
+			resp.StatusCode, string(body))
+	}
+
+	// Decode the response and check for error.
+	tmCompanies, err := decodeTrackerMapping(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding response body from TrackerMapper API: %s", err.Error())
+	}
+	return tmCompanies, nil
+}
+
+// maxErrBodyLen is the number of bytes of a failed response's body that are
+// included in the error.
+const maxErrBodyLen = 512
+
+// decodeTrackerMapping decodes a TrackerMapper response body. The API may
+// respond with either a single company object or a list of them.
+func decodeTrackerMapping(body io.Reader) ([]db.TrackerMapperCompany, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '{' {
+		var tmCompany db.TrackerMapperCompany
+		if err := json.Unmarshal(raw, &tmCompany); err != nil {
+			return nil, err
+		}
+		return []db.TrackerMapperCompany{tmCompany}, nil
+	}
+
+	var tmCompanies []db.TrackerMapperCompany
+	if err := json.Unmarshal(raw, &tmCompanies); err != nil {
+		return nil, err
+	}
+	return tmCompanies, nil
+}
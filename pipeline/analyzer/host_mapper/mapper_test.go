@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTrackerMapping(t *testing.T) {
+	for _, test := range []struct {
+		body     string
+		expected string
+	}{
+		{`{"hostName": "tracker.com", "companyName": "Tracker", "locale": "us"}`, "[tracker.com:Tracker/us]"},
+		{` [{"hostName": "tracker.com", "companyName": "Tracker"}, {"hostName": "ads.com", "companyName": "Ads"}]`,
+			"[tracker.com:Tracker/ ads.com:Ads/]"},
+		{`[]`, "[]"},
+	} {
+		tmCompanies, err := decodeTrackerMapping(strings.NewReader(test.body))
+		if err != nil {
+			t.Errorf("Failed to decode %s: %s", test.body, err.Error())
+			continue
+		}
+		var got []string
+		for _, c := range tmCompanies {
+			got = append(got, c.HostName+":"+c.CompanyName+"/"+c.Locale)
+		}
+		if fmt.Sprint(got) != test.expected {
+			t.Errorf("Got %v for %s, expected %s", got, test.body, test.expected)
+		}
+	}
+
+	for _, body := range []string{``, `"tracker.com"`, `{"companyName": 1}`, `[{"hostName": "a"`} {
+		if _, err := decodeTrackerMapping(strings.NewReader(body)); err == nil {
+			t.Errorf("Expected decoding %q to fail", body)
+		}
+	}
+}
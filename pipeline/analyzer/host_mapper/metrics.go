@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	appsProcessed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "xray",
+		Subsystem: "host_mapper",
+		Name:      "apps_processed_total",
+		Help:      "Apps whose hosts have been mapped.",
+	})
+	hostsLookedUp = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "xray",
+		Subsystem: "host_mapper",
+		Name:      "hosts_looked_up_total",
+		Help:      "Hosts sent to the TrackerMapper API.",
+	})
+	hostCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "xray",
+		Subsystem: "host_mapper",
+		Name:      "host_cache_hits_total",
+		Help:      "Hosts whose companies were found in the cache instead of being looked up.",
+	})
+	companiesInserted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "xray",
+		Subsystem: "host_mapper",
+		Name:      "companies_inserted_total",
+		Help:      "Companies written to the database, once each per run, including ones already there.",
+	})
+	trackerMapperErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "xray",
+		Subsystem: "host_mapper",
+		Name:      "tracker_mapper_errors_total",
+		Help:      "Failed TrackerMapper API requests.",
+	})
+	trackerMapperLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "xray",
+		Subsystem: "host_mapper",
+		Name:      "tracker_mapper_request_duration_seconds",
+		Help:      "Latency of TrackerMapper API requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(appsProcessed, hostsLookedUp, hostCacheHits, companiesInserted,
+		trackerMapperErrors, trackerMapperLatency)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sociam/xray-archiver/pipeline/util"
+)
+
+// progressWindow is the time over which the rate apps are processed at is
+// averaged. Rates measured longer ago than this have a weight of less than 1/e.
+const progressWindow = time.Minute
+
+// progressReporter logs how many of a run's apps have been processed, the
+// rate they're processed at and when the run should finish, after every
+// every apps and every interval, if they are positive.
+type progressReporter struct {
+	total, every int64
+	stopped      chan struct{}
+
+	mu       sync.Mutex
+	start    time.Time
+	done     int64
+	lastDone int64
+	lastAt   time.Time
+	// rate is an exponentially weighted moving average of the apps
+	// processed per second, or -1 before the first report.
+	rate float64
+}
+
+// newProgressReporter returns a progressReporter for a run of total apps,
+// where a total of 0 or less means the number isn't known. Stop must be
+// called when the run is done.
+func newProgressReporter(total, every int64, interval time.Duration) *progressReporter {
+	now := time.Now()
+	p := &progressReporter{
+		total:   total,
+		every:   every,
+		stopped: make(chan struct{}),
+		start:   now,
+		lastAt:  now,
+		rate:    -1,
+	}
+	if interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-p.stopped:
+					return
+				case <-ticker.C:
+					p.mu.Lock()
+					p.report(time.Now())
+					p.mu.Unlock()
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// Add records that an app has been processed.
+func (p *progressReporter) Add() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if p.every > 0 && p.done-p.lastDone >= p.every {
+		p.report(time.Now())
+	}
+}
+
+// Stop stops reporting on an interval.
+func (p *progressReporter) Stop() {
+	close(p.stopped)
+}
+
+// report updates the rate and logs the progress. p.mu must be held.
+func (p *progressReporter) report(now time.Time) {
+	elapsed := now.Sub(p.lastAt)
+	if elapsed <= 0 {
+		return
+	}
+	sample := float64(p.done-p.lastDone) / elapsed.Seconds()
+	if p.rate < 0 {
+		p.rate = sample
+	} else {
+		// Weigh the new sample by how long it was measured over, so that
+		// reports after every apps and on the interval count alike.
+		alpha := 1 - math.Exp(-float64(elapsed)/float64(progressWindow))
+		p.rate = alpha*sample + (1-alpha)*p.rate
+	}
+	p.lastDone, p.lastAt = p.done, now
+
+	running := now.Sub(p.start).Round(time.Second)
+	if p.total <= 0 {
+		util.Log.Info("Progress: %d apps in %s, %.1f apps/s", p.done, running, p.rate)
+		return
+	}
+
+	eta := "unknown"
+	if remaining := p.total - p.done; remaining <= 0 {
+		eta = "0s"
+	} else if p.rate > 0 {
+		eta = time.Duration(float64(remaining) / p.rate * float64(time.Second)).Round(time.Second).String()
+	}
+	util.Log.Info("Progress: %d/%d apps (%.1f%%) in %s, %.1f apps/s, ETA %s",
+		p.done, p.total, 100*float64(p.done)/float64(p.total), running, p.rate, eta)
+}
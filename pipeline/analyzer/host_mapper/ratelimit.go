@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by the workers, allowing up to burst
+// requests at once and rate requests per second on average.
+type rateLimiter struct {
+	tokens chan struct{}
+}
+
+// newRateLimiter returns a rateLimiter that is refilled until ctx is done. A
+// rate of 0 or less means no limit, and a nil rateLimiter is returned, as it
+// is for rates too high to refill at, of more than one request a nanosecond.
+func newRateLimiter(ctx context.Context, rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	if interval <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	l := &rateLimiter{tokens: make(chan struct{}, burst)}
+	for i := 0; i < burst; i++ {
+		l.tokens <- struct{}{}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				select {
+				case l.tokens <- struct{}{}:
+				default:
+					// The bucket is full.
+				}
+			}
+		}
+	}()
+	return l
+}
+
+// Wait blocks until a request may be made, or ctx is done.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-l.tokens:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
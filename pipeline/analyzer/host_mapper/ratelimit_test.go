@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, rate := range []float64{0, -1, 2e9} {
+		if l := newRateLimiter(ctx, rate, 1); l != nil {
+			t.Errorf("Expected no limit for a rate of %g", rate)
+		} else if err := l.Wait(ctx); err != nil {
+			t.Errorf("Expected Wait to succeed without a limit, got %s", err.Error())
+		}
+	}
+
+	// The burst is available at once, then tokens come at the rate.
+	l := newRateLimiter(ctx, 20, 3)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := l.Wait(ctx); err != nil {
+			t.Fatalf("Wait failed: %s", err.Error())
+		}
+		if elapsed := time.Since(start); i < 3 && elapsed > 25*time.Millisecond {
+			t.Errorf("Expected token %d of the burst at once, waited %s", i, elapsed)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected the token after the burst to be rate limited, waited %s", elapsed)
+	}
+
+	// Waiting gives up when the context is done.
+	l = newRateLimiter(ctx, 0.001, 1)
+	l.Wait(ctx)
+	waitCtx, waitCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer waitCancel()
+	if err := l.Wait(waitCtx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Wait to time out, got %v", err)
+	}
+}
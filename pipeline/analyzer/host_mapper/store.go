@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+
+	"github.com/sociam/xray-archiver/pipeline/db"
+)
+
+// mapStore is the database as used by a mapRun, through which runs can be
+// tested without one.
+type mapStore interface {
+	GetAppHostIDsPaged(ctx context.Context, offset, limit int) ([]int64, error)
+	GetAppHosts(ctx context.Context, appID int64) (db.AppHostRecord, error)
+	InsertCompanyName(name string) error
+	InsertCompanyAppAssociation(appID int64, name string) error
+	BatchInsertCompanies(companies []db.TrackerMapperCompany) error
+	BatchAddAppCompanies(assocs []db.AppTrackerCompany) error
+	InsertCompany(company db.TrackerMapperCompany) (int64, error)
+	AddAppCompany(appID, companyID int64, host string) error
+	SetAppMapped(appID int64) error
+}
+
+// dbStore is the mapStore backed by the db package.
+type dbStore struct{}
+
+func (dbStore) GetAppHostIDsPaged(ctx context.Context, offset, limit int) ([]int64, error) {
+	return db.GetAppHostIDsPagedContext(ctx, offset, limit)
+}
+
+func (dbStore) GetAppHosts(ctx context.Context, appID int64) (db.AppHostRecord, error) {
+	return db.GetAppHostsByIDContext(ctx, appID)
+}
+
+func (dbStore) InsertCompanyName(name string) error {
+	return db.InsertCompanyName(name)
+}
+
+func (dbStore) InsertCompanyAppAssociation(appID int64, name string) error {
+	return db.InsertCompanyAppAssociation(appID, name)
+}
+
+func (dbStore) BatchInsertCompanies(companies []db.TrackerMapperCompany) error {
+	return db.BatchInsertCompanies(companies)
+}
+
+func (dbStore) BatchAddAppCompanies(assocs []db.AppTrackerCompany) error {
+	return db.BatchAddAppCompanies(assocs)
+}
+
+func (dbStore) InsertCompany(company db.TrackerMapperCompany) (int64, error) {
+	return db.InsertCompany(company)
+}
+
+func (dbStore) AddAppCompany(appID, companyID int64, host string) error {
+	return db.AddAppCompany(appID, companyID, host)
+}
+
+func (dbStore) SetAppMapped(appID int64) error {
+	return db.SetAppMapped(appID)
+}
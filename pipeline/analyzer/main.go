@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
+	"path"
+	"strings"
 	"sync"
 	"time"
 
@@ -44,21 +48,49 @@ func analyze(app *util.App) error {
 		return fmt.Errorf("Error unpacking apk: %s", err.Error())
 	}
 	fmt.Printf("Unpacked app %s version %s\n", app.ID, app.Ver)
+	if app.ResourcesUndecoded {
+		fmt.Println("Couldn't decode the app's resources, they won't be analyzed")
+	}
+
+	hash, err := app.Hash()
+	if err != nil {
+		fmt.Printf("Error hashing apk: %s\n", err.Error())
+	} else {
+		err = db.SetAPKHash(app.DBID, hash)
+		if err != nil {
+			fmt.Printf("Error writing apk hash to DB: %s\n", err.Error())
+		}
+	}
 
 	fmt.Println("Getting permissions...")
-	manifest, gotIcon, err := parseManifest(app)
+	manifest, err := parseManifest(app)
 	if err != nil {
 		fmt.Println("Error parsing manifest: ", err.Error())
 	} else {
 		app.Perms = manifest.getPerms()
+		if len(app.Splits) > 0 {
+			// Merge in the permissions requested by the splits.
+			if err := app.ParsePermissions(); err != nil {
+				fmt.Printf("Error parsing split manifests: %s\n", err.Error())
+			}
+			for split, perms := range app.SplitPerms {
+				fmt.Printf("Permissions only requested by split %s: %v\n", split, perms)
+			}
+		}
 		fmt.Printf("Permissions found: %v\n\n", app.Perms)
 		err = db.AddPerms(app)
 		if err != nil {
 			fmt.Printf("Error writing permissions to DB: %s\n", err.Error())
 		}
-		if gotIcon {
+		if icon, err := app.ExtractIcon(); err != nil {
+			if !errors.Is(err, util.ErrNoIcon) {
+				fmt.Printf("Error extracting icon: %s\n", err.Error())
+			}
+		} else {
+			// The icon is served from the directory of the APK, which
+			// ExtractIcon copies it to whatever the storage layout.
 			app.Icon = "/" + url.PathEscape(app.ID) + "/" + url.PathEscape(app.Store) +
-				"/" + url.PathEscape(app.Region) + "/" + url.PathEscape(app.Ver) + "/icon.png"
+				"/" + url.PathEscape(app.Region) + "/" + url.PathEscape(app.Ver) + "/" + path.Base(icon)
 			fmt.Printf("Got icon: %s\n", app.Icon)
 			err = db.SetIcon(app.DBID, app.Icon)
 			if err != nil {
@@ -72,12 +104,59 @@ func analyze(app *util.App) error {
 	if err != nil {
 		fmt.Printf("Error getting hosts: %s\n", err.Error())
 	} else {
+		// Add the hosts referenced by the decoded code and resources.
+		extracted, err := app.ExtractHosts()
+		if err != nil {
+			fmt.Printf("Error extracting hosts from decoded files: %s\n", err.Error())
+		}
+		good := extracted[:0]
+		for _, host := range extracted {
+			if _, ok := badHosts[host]; !ok {
+				good = append(good, host)
+			}
+		}
+		app.Hosts = util.UniqAppend(app.Hosts, good)
 		fmt.Printf("Hosts found: %v\n\n", app.Hosts)
+		if len(app.HostIPs) > 0 {
+			fmt.Printf("IP addresses found: %v\n\n", app.HostIPs)
+		}
+
+		cleartext, err := app.CheckCleartext()
+		if err != nil {
+			fmt.Printf("Error checking cleartext hosts: %s\n", err.Error())
+		} else if len(cleartext) > 0 {
+			fmt.Printf("Hosts contacted over cleartext HTTP: %v\n\n", cleartext)
+			if err := db.AddCleartextHosts(app.DBID, cleartext); err != nil {
+				fmt.Printf("Error writing cleartext hosts to DB: %s\n", err.Error())
+			}
+		}
 
-		err = db.AddHosts(app, app.Hosts)
+		err = db.AddHosts(app, util.UniqAppend(app.Hosts, app.HostIPs))
 		if err != nil {
 			fmt.Printf("Error writing hosts to DB: %s\n", err.Error())
 		}
+
+		// Archive where the hosts are, rather than have apiserv look them up
+		// on demand.
+		geo, err := app.GeoIPAll(util.Cfg.GeoIPEndpoint, 0)
+		if err != nil {
+			fmt.Printf("Error looking up GeoIP info of hosts: %s\n", err.Error())
+		}
+		for host, infos := range geo {
+			if err := db.InsertGeoIP(app.DBID, host, infos); err != nil {
+				fmt.Printf("Error writing GeoIP info of %s to DB: %s\n", host, err.Error())
+			}
+		}
+	}
+
+	if comps, err := app.Components(); err != nil {
+		fmt.Printf("Error parsing components: %s\n", err.Error())
+	} else if unguarded := comps.Unguarded(); len(unguarded) > 0 {
+		names := make([]string, 0, len(unguarded))
+		for _, c := range unguarded {
+			names = append(names, c.Name)
+		}
+		fmt.Printf("Components exported without a permission: %v\n\n", names)
 	}
 
 	err = checkReflect(app)
@@ -92,6 +171,26 @@ func analyze(app *util.App) error {
 		}
 	}
 
+	if secrets, err := app.ScanSecrets(secretPatterns); err != nil {
+		fmt.Printf("Error scanning for secrets: %s\n", err.Error())
+	} else {
+		for _, s := range secrets {
+			fmt.Printf("Possible %s in %s:%d: %s\n", s.Pattern, s.Path, s.Line, s.Preview)
+		}
+	}
+
+	if bridges, err := app.WebViewBridges(); err == util.ErrNoSmali {
+		fmt.Println("WebView bridges weren't scanned for, as the app's code wasn't disassembled")
+	} else if err != nil {
+		fmt.Printf("Error finding WebView bridges: %s\n", err.Error())
+	} else if len(bridges) > 0 {
+		fmt.Printf("WebView bridges: %v\n\n", bridges)
+	}
+
+	if knownSDKs != nil {
+		fmt.Printf("SDKs found: %v\n\n", app.DetectSDKs(knownSDKs))
+	}
+
 	// app.Packages, err = findPackages(app)
 	// if err != nil {
 	// 	fmt.Println("Error finding packages: ", err.Error())
@@ -118,7 +217,16 @@ func analyze(app *util.App) error {
 
 func runServer() {
 	fmt.Println("Checking APK Unpack Directory:", util.Cfg.StorageConfig.APKUnpackDirectory)
-	util.CheckDir(util.Cfg.StorageConfig.APKUnpackDirectory, "Unpacked APK directory")
+	if err := util.CheckDir(util.Cfg.StorageConfig.APKUnpackDirectory, "Unpacked APK directory"); err != nil {
+		log.Fatalf("Failed to check APK unpack directory: %s", err.Error())
+	}
+
+	// Remove apps left unpacked by previous runs that didn't clean up.
+	if n, err := util.SweepStaleUnpackDirs(24 * time.Hour); err != nil {
+		fmt.Println("Error removing stale unpack directories:", err.Error())
+	} else if n > 0 {
+		fmt.Printf("Removed %d stale unpack directories\n", n)
+	}
 
 	for {
 		apps, err := db.GetAppsToAnalyze()
@@ -146,8 +254,18 @@ func runServer() {
 	}
 }
 
+// knownSDKs maps package prefixes to the SDKs reported by analyze, if
+// known_sdks_path is configured.
+var knownSDKs map[string]string
+
+// secretPatterns are the patterns analyze scans apps for secrets with: the
+// default ones and those in secret_patterns_path, if it is configured.
+var secretPatterns = util.DefaultSecretPatterns()
+
 var cfgFile = flag.String("cfg", "/etc/xray/config.json", "config file location")
 var daemon = flag.Bool("daemon", false, "run analyzer as a daemon")
+var force = flag.Bool("force", false, "unpack apps again even if they were already unpacked (default force_unpack)")
+var splits = flag.String("splits", "", "comma separated split APKs of the app being analyzed, when analyzing a single app")
 var useDb = flag.Bool("db", false, "add app information to the db specified in the config file")
 
 func init() {
@@ -157,17 +275,78 @@ func init() {
 	if err != nil {
 		log.Fatalf("Failed to read config: %s", err.Error())
 	}
-	err = db.Open(util.Cfg, *useDb)
+	if *force {
+		util.Cfg.ForceUnpack = true
+	}
+	// migrate always needs the database.
+	if *useDb || flag.Arg(0) == "migrate" {
+		err = db.OpenWithRetry(util.Cfg, util.Cfg.DB.ConnectWait)
+	} else {
+		err = db.Open(util.Cfg, false)
+	}
 	if err != nil {
 		log.Fatalf("Failed to open a connection to the database: %s", err.Error())
 	}
 }
 
+// migrate creates or upgrades the database schema.
+func migrate() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	defer db.Close()
+
+	if err := db.Migrate(ctx); err != nil {
+		log.Fatalf("Failed to migrate the database: %s", err.Error())
+	}
+	fmt.Println("Database is up to date")
+}
+
 func main() {
+	if flag.Arg(0) == "migrate" {
+		migrate()
+		return
+	}
+	defer db.Close()
+
 	if err := os.MkdirAll(util.Cfg.StorageConfig.APKUnpackDirectory, 0755); err != nil {
 		panic(err)
 	}
 
+	apktoolVersion, err := util.CheckApktool()
+	if err != nil {
+		log.Fatalf("Failed to check apktool: %s", err.Error())
+	}
+	fmt.Println("Using apktool", apktoolVersion)
+
+	if util.Cfg.KnownSDKsPath != "" {
+		knownSDKs, err = util.LoadKnownSDKs(util.Cfg.KnownSDKsPath)
+		if err != nil {
+			log.Fatalf("Failed to load known SDKs: %s", err.Error())
+		}
+	}
+	if util.Cfg.SecretPatternsPath != "" {
+		patterns, err := util.LoadSecretPatterns(util.Cfg.SecretPatternsPath)
+		if err != nil {
+			log.Fatalf("Failed to load secret patterns: %s", err.Error())
+		}
+		secretPatterns = append(secretPatterns, patterns...)
+	}
+
+	if flag.Arg(0) == "serve" {
+		serve()
+		return
+	}
+	if flag.Arg(0) == "install-framework" {
+		if flag.NArg() != 2 {
+			log.Fatal("usage: analyzer install-framework <framework apk>")
+		}
+		if err := util.InstallFramework(flag.Arg(1)); err != nil {
+			log.Fatalf("Failed to install framework: %s", err.Error())
+		}
+		fmt.Println("Installed framework", flag.Arg(1))
+		return
+	}
+
 	if *daemon {
 		fmt.Println("Starting xray analyzer daemon")
 		runServer()
@@ -177,9 +356,16 @@ func main() {
 			os.Exit(64)
 		}
 
+		if *splits != "" && flag.NArg() != 1 {
+			log.Fatal("-splits can only be used when analyzing a single app")
+		}
+
 		for _, appPath := range flag.Args() {
 			app := util.AppByPath(appPath)
 			app.Store = "cli"
+			if *splits != "" {
+				app.Splits = strings.Split(*splits, ",")
+			}
 			fmt.Println("Analyzing apk ", appPath)
 			analyze(app)
 		}
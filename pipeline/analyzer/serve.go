@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sociam/xray-archiver/pipeline/util"
+)
+
+// analyzeParams are the params of an analyze request made to `analyzer
+// serve`: the path of an APK, and optionally of its splits.
+type analyzeParams struct {
+	APKPath string   `json:"apk_path"`
+	Splits  []string `json:"splits"`
+}
+
+// analyzeResult is the result of an analyze request.
+type analyzeResult struct {
+	Permissions []util.Permission `json:"permissions"`
+	Hosts       []string          `json:"hosts"`
+	HostIPs     []string          `json:"host_ips"`
+}
+
+// handleRequest answers the requests made to `analyzer serve`. The only
+// method is analyze, which unpacks the APK at params.apk_path and returns the
+// permissions it requests and the hosts found in it. Nothing is written to the
+// database.
+func handleRequest(req util.SocketRequest) (interface{}, error) {
+	if req.Method != "analyze" {
+		return nil, fmt.Errorf("unknown method %q", req.Method)
+	}
+	var params analyzeParams
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		return nil, fmt.Errorf("invalid params: %s", err.Error())
+	}
+	if params.APKPath == "" {
+		return nil, errors.New("apk_path must be set")
+	}
+
+	app := util.AppByPath(params.APKPath)
+	app.Store = "cli"
+	app.Splits = params.Splits
+	defer app.Cleanup()
+
+	if err := app.Unpack(); err != nil {
+		return nil, fmt.Errorf("couldn't unpack apk: %s", err.Error())
+	}
+	if err := app.ParsePermissions(); err != nil {
+		return nil, fmt.Errorf("couldn't parse permissions: %s", err.Error())
+	}
+	extracted, err := app.ExtractHosts()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't extract hosts: %s", err.Error())
+	}
+
+	result := analyzeResult{Permissions: app.Perms, Hosts: []string{}, HostIPs: app.HostIPs}
+	for _, host := range extracted {
+		if _, ok := badHosts[host]; !ok {
+			result.Hosts = append(result.Hosts, host)
+		}
+	}
+	if result.Permissions == nil {
+		result.Permissions = []util.Permission{}
+	}
+	if result.HostIPs == nil {
+		result.HostIPs = []string{}
+	}
+	return result, nil
+}
+
+// serve answers analyze requests on the socket at util.Cfg.SockPath until
+// the analyzer is interrupted.
+func serve() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv, err := util.ServeSocket(util.Cfg.SockPath, handleRequest)
+	if err != nil {
+		log.Fatalf("Failed to serve analysis requests: %s", err.Error())
+	}
+	<-ctx.Done()
+
+	fmt.Println("Shutting down, waiting for requests being analyzed")
+	if err := srv.Close(); err != nil {
+		fmt.Printf("Error closing socket: %s\n", err.Error())
+	}
+}
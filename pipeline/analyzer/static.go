@@ -28,55 +28,25 @@ type manifestApp struct {
 	Icon string `xml:"icon,attr"`
 }
 
-func parseManifest(app *util.App) (manifest *AndroidManifest, gotIcon bool, err error) {
+func parseManifest(app *util.App) (manifest *AndroidManifest, err error) {
 	manifest = &AndroidManifest{}
 	manifestFile, err := os.Open(path.Join(app.OutDir(), "AndroidManifest.xml"))
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 	bytes, err := ioutil.ReadAll(manifestFile)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 	err = xml.Unmarshal(bytes, manifest)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 
 	if manifest.Package != "" {
 		app.ID = manifest.Package
 	}
-
-	split := strings.SplitN(manifest.Application.Icon, "/", 2)
-	if len(split) != 2 {
-		return manifest, false, nil
-	}
-	locn, name := split[0], split[1]
-	if len(locn) < 1 {
-		return manifest, false, nil
-	}
-	locn = path.Join(app.OutDir(), "res", locn[1:]) // /tmp/<outdir>/res/{mipmap,drawable}
-	name = name + ".png"                            // icon_katana.png
-
-	var matches []string
-	if matches, err = filepath.Glob(path.Join(locn+"-*xxxdpi*", name)); err == nil && len(matches) > 0 {
-	} else if matches, err = filepath.Glob(path.Join(locn+"-*xxdpi*", name)); err == nil && len(matches) > 0 {
-	} else if matches, err = filepath.Glob(path.Join(locn+"-*xdpi*", name)); err == nil && len(matches) > 0 {
-	} else if matches, err = filepath.Glob(path.Join(locn+"-*hdpi*", name)); err == nil && len(matches) > 0 {
-	} else if matches, err = filepath.Glob(path.Join(locn+"-*tvdpi*", name)); err == nil && len(matches) > 0 {
-	} else if matches, err = filepath.Glob(path.Join(locn+"-*mdpi*", name)); err == nil && len(matches) > 0 {
-	} else if matches, err = filepath.Glob(path.Join(locn+"*", name)); err == nil && len(matches) > 0 {
-	} else {
-		return manifest, false, nil
-	}
-
-	err = os.Rename(matches[0], path.Join(app.AppDir(), "icon.png"))
-	if err != nil {
-		fmt.Printf("Failed to rename icon %s to %s", matches[0], path.Join(app.AppDir(), "icon.png"))
-		return manifest, false, nil
-	}
-
-	return manifest, true, nil
+	return manifest, nil
 }
 
 func (manifest *AndroidManifest) getPerms() []util.Permission {
@@ -143,6 +113,19 @@ func simpleAnalyze(app *util.App) ([]string, error) {
 	if err != nil {
 		return []string{}, err
 	}
+
+	// Feature splits can have code of their own.
+	for _, split := range app.Splits {
+		dex := path.Join(app.SplitDir(split), "classes.dex")
+		if _, err := os.Stat(dex); err != nil {
+			continue
+		}
+		splitOut, err := exec.Command("strings", "-n", "11", dex).Output()
+		if err != nil {
+			return []string{}, err
+		}
+		out = append(out, splitOut...)
+	}
 	hostre.Longest()
 	matches := hostre.FindAllSubmatch(out, -1)
 
@@ -182,6 +165,16 @@ func simpleAnalyze(app *util.App) ([]string, error) {
 }
 
 func checkReflect(app *util.App) error {
+	// Prefer scanning the smali output, which says where reflection is used.
+	_, sites, err := app.DetectReflection()
+	if err == nil {
+		fmt.Printf("Found %d uses of reflection\n", len(sites))
+		return nil
+	} else if err != util.ErrNoSmali {
+		return err
+	}
+	fmt.Println("The app's code wasn't disassembled, checking classes.dex for reflection instead")
+
 	cmd := exec.Command("grep", "-Paqh",
 		"\\x00\\x00\\x00.Ljava/lang/reflect[/a-zA-Z]*;\\x00\\x00\\x00",
 		"--", path.Join(app.OutDir(), "classes.dex"))
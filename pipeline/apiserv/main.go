@@ -635,6 +635,7 @@ func fetchHosts(w http.ResponseWriter, r *http.Request) {
 		util.Log.Debug("Checking over hosts: %s\n", hosts)
 
 		hostToGeoip := map[string][]util.GeoIPInfo{}
+		var mu sync.Mutex
 
 		wg := sync.WaitGroup{}
 		for i := range hosts {
@@ -642,11 +643,15 @@ func fetchHosts(w http.ResponseWriter, r *http.Request) {
 			util.Log.Debug("Getting host geo ip: %s\n", hosts[i])
 			wg.Add(1)
 			go func() {
-				var geoip []util.GeoIPInfo
+				geoip, err := util.GetHostGeoIP(util.Cfg.GeoIPEndpoint, hosts[j])
 
-				geoip, err = util.GetHostGeoIP(util.Cfg.GeoIPEndpoint, hosts[j])
-
-				if err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				if _, partial := err.(util.GeoIPErrors); partial && len(geoip) > 0 {
+					// Some of the host's IPs were looked up, so return those.
+					util.Log.Notice("Host %s could only be partially looked up: %s", hosts[j], err.Error())
+					hostToGeoip[hosts[j]] = geoip
+				} else if err != nil {
 					// TODO: immedoiately fail? change status to accepted 202 and 200 and
 					// BADREQUEST when all is well with all hosts.
 
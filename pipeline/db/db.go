@@ -1,9 +1,14 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -17,6 +22,13 @@ type xrayDb struct {
 var useDB bool
 var db xrayDb
 
+// batchSize is the maximum number of rows inserted by a single statement in
+// the Batch* functions. Postgres allows at most 65535 parameters in a
+// statement, and each row takes 4, so it is capped at maxBatchSize.
+var batchSize = 500
+
+const maxBatchSize = 65535 / 4
+
 // Open opens the database with the given config. If enable is false, the
 // functions that modify the database are noops.
 func Open(cfg util.Config, enable bool) error {
@@ -30,9 +42,159 @@ func Open(cfg util.Config, enable bool) error {
 		}
 		db = xrayDb{sqlDb}
 	}
+	if cfg.DB.BatchSize > 0 {
+		batchSize = minInt(cfg.DB.BatchSize, maxBatchSize)
+	}
 	return nil
 }
 
+// maxOpenRetryDelay caps the delay between attempts to reach the database in
+// OpenWithRetry.
+const maxOpenRetryDelay = 10 * time.Second
+
+// OpenWithRetry is like Open with enable set, but then waits for the database
+// to be reachable, e.g. when it is started at the same time as the program.
+// It pings the database, backing off exponentially between attempts, until it
+// responds or maxWait has passed. Authentication failures aren't retried.
+func OpenWithRetry(cfg util.Config, maxWait time.Duration) error {
+	if err := Open(cfg, true); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(maxWait)
+	delay := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := Ping(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && strings.HasPrefix(string(pqErr.Code), "28") {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("database unreachable after %d attempts: %s", attempt, err.Error())
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		util.Log.Warning("Database unreachable, retrying in %s (attempt %d): %s", delay, attempt, err.Error())
+		time.Sleep(delay)
+		if delay *= 2; delay > maxOpenRetryDelay {
+			delay = maxOpenRetryDelay
+		}
+	}
+}
+
+// Ping checks that the database can be reached.
+func Ping(ctx context.Context) error {
+	if db.DB == nil {
+		return errors.New("database isn't open")
+	}
+	return db.DB.PingContext(ctx)
+}
+
+// maxReconnectAttempts is the number of times a query that failed because the
+// connection to the database was lost is retried.
+const maxReconnectAttempts = 3
+
+// isConnError reports whether err means the connection to the database was
+// lost before the statement reached the server, so that it is safe to run it
+// again: either the driver found the connection broken before sending it
+// (driver.ErrBadConn), or a new connection couldn't be dialed. Errors such as
+// a connection reset while waiting for the result aren't, since the server
+// may already have committed the statement, and running e.g. an insert or an
+// increment again would apply it twice.
+func isConnError(err error) bool {
+	var netErr *net.OpError
+	return errors.Is(err, driver.ErrBadConn) ||
+		(errors.As(err, &netErr) && netErr.Op == "dial")
+}
+
+// retryConn calls f until it doesn't fail with a connection error, as
+// reported by isConnError, up to maxReconnectAttempts extra times. The
+// connection pool drops broken connections, so each retry uses a new one. It
+// gives up early if ctx is done.
+func retryConn(ctx context.Context, f func() error) error {
+	err := f()
+	for attempt := 1; attempt <= maxReconnectAttempts && isConnError(err) && ctx.Err() == nil; attempt++ {
+		util.Log.Warning("Lost connection to the database, reconnecting (attempt %d of %d): %s",
+			attempt, maxReconnectAttempts, err.Error())
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+			return err
+		}
+		err = f()
+	}
+	return err
+}
+
+// Query is sql.DB.Query, retrying if the connection to the database was lost.
+func (d xrayDb) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return d.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext is sql.DB.QueryContext, retrying if the connection to the
+// database was lost.
+func (d xrayDb) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := retryConn(ctx, func() error {
+		var err error
+		rows, err = d.DB.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// QueryRow is sql.DB.QueryRow, retrying if the connection to the database was
+// lost.
+func (d xrayDb) QueryRow(query string, args ...interface{}) *sql.Row {
+	return d.QueryRowContext(context.Background(), query, args...)
+}
+
+// QueryRowContext is sql.DB.QueryRowContext, retrying if the connection to
+// the database was lost.
+func (d xrayDb) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	var row *sql.Row
+	retryConn(ctx, func() error {
+		row = d.DB.QueryRowContext(ctx, query, args...)
+		return row.Err()
+	})
+	return row
+}
+
+// Exec is sql.DB.Exec, retrying if the connection to the database was lost.
+func (d xrayDb) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext is sql.DB.ExecContext, retrying if the connection to the
+// database was lost.
+func (d xrayDb) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := retryConn(ctx, func() error {
+		var err error
+		res, err = d.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	return res, err
+}
+
+// Close closes the database, waiting for any queries in progress to finish.
+// It is safe to call if Open was never called or the database is already
+// closed.
+func Close() error {
+	if db.DB == nil {
+		return nil
+	}
+	return db.DB.Close()
+}
+
 //TODO: make Add* functions take a db id and what to add instead of a util.App
 
 // SetLastAnalyzeAttempt sets the last_analyzed_attempt of an app to the
@@ -189,6 +351,19 @@ func SetReflect(id int64, val bool) error {
 	return err
 }
 
+// SetAPKHash sets the SHA-256 digest of the APK of an app version.
+func SetAPKHash(id int64, hash string) error {
+	if !useDB || id == 0 {
+		return nil
+	}
+
+	rows, err := db.Query("UPDATE app_versions SET apk_sha256 = $1 WHERE id = $2", hash, id)
+	if rows != nil {
+		rows.Close()
+	}
+	return err
+}
+
 // GetAppVersion gets an app version from the database. The argument app is the
 // app id, in the form com.example.app.
 func GetAppVersion(app, store, region, version string) (AppVersion, error) {
@@ -338,14 +513,59 @@ func GetDeveloper(id int64) (Developer, error) {
 
 }
 
+// GetAppHostIDsPaged returns up to limit app_hosts IDs in ascending order,
+// skipping the first offset of them.
+func GetAppHostIDsPaged(offset, limit int) ([]int64, error) {
+	return GetAppHostIDsPagedContext(context.Background(), offset, limit)
+}
+
+// GetAppHostIDsPagedContext is GetAppHostIDsPaged, with its queries cancelled
+// when ctx is done.
+func GetAppHostIDsPagedContext(ctx context.Context, offset, limit int) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM app_hosts ORDER BY id LIMIT $1 OFFSET $2", limit, offset)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		util.Log.Err("Error querying app_hosts for ids: %s", err.Error())
+		return nil, err
+	}
+
+	ids := make([]int64, 0, limit)
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		util.Log.Err("Error querying app_hosts for ids: %s", err.Error())
+		return nil, err
+	}
+	return ids, nil
+}
+
 // GetAppHostsByID selects an app host record from the DB using the provided ID
 func GetAppHostsByID(id int64) (AppHostRecord, error) {
+	return GetAppHostsByIDContext(context.Background(), id)
+}
+
+// GetAppHostsByIDContext is GetAppHostsByID, with its queries cancelled when
+// ctx is done.
+func GetAppHostsByIDContext(ctx context.Context, id int64) (AppHostRecord, error) {
 	var appHosts AppHostRecord
 
 	util.Log.Debug("Requesting App Host info for App with ID: %d", id)
-	db.QueryRow("select id, hosts from app_hosts where id = $1", id).Scan(
+	err := db.QueryRowContext(ctx,
+		`select h.id, h.hosts, coalesce(v.region, '') from app_hosts h
+		left join app_versions v on v.id = h.id where h.id = $1`, id).Scan(
 		&appHosts.ID,
-		pq.Array(&appHosts.HostNames))
+		pq.Array(&appHosts.HostNames),
+		&appHosts.Region)
+	if err != nil {
+		return AppHostRecord{}, err
+	}
 
 	util.Log.Debug("Finished Selecting app_hosts record for id: %d. Returning AppHostsRecord Object.", id)
 
@@ -354,29 +574,39 @@ func GetAppHostsByID(id int64) (AppHostRecord, error) {
 
 // IncrementCompanyAppAssociationCount increments the counter on the associated app and company
 func IncrementCompanyAppAssociationCount(appID int64, companyName string) error {
-	if !HasAppVersionID(appID) {
+	return IncrementCompanyAppAssociationCountContext(context.Background(), appID, companyName)
+}
+
+// IncrementCompanyAppAssociationCountContext is
+// IncrementCompanyAppAssociationCount, with its queries cancelled when ctx is
+// done.
+func IncrementCompanyAppAssociationCountContext(ctx context.Context, appID int64, companyName string) error {
+	if !HasAppVersionIDContext(ctx, appID) {
 		util.Log.Warning("App ID: %d Not Found", appID)
 		return nil
 	}
 
-	if !HasCompanyName(companyName) {
+	if !HasCompanyNameContext(ctx, companyName) {
 		util.Log.Warning("Company Name %s Not Found", companyName)
 		return nil
 	}
 
-	if !HasCompanyAppAssociation(appID, companyName) {
+	if !HasCompanyAppAssociationContext(ctx, appID, companyName) {
 		util.Log.Debug("Company-App association between app: %d and company: %s Not Found", appID, companyName)
 		return nil
 	}
 
-	rows, err := db.Query(
+	rows, err := db.QueryContext(ctx,
 		"update companyappassociations set number_of_associations = number_of_associations + 1 where company_name=$1 and associated_app=$2",
 		companyName,
 		appID)
-	rows.Close()
+	if rows != nil {
+		rows.Close()
+	}
 
 	if err != nil {
 		util.Log.Err("Error incrementing number of associations for companyAppAssociation between Company: %s and app with ID: %d", companyName, appID, err)
+		return err
 	}
 
 	return nil
@@ -384,24 +614,32 @@ func IncrementCompanyAppAssociationCount(appID int64, companyName string) error
 
 // InsertCompanyAppAssociation inserts an app and company name association into the database.
 func InsertCompanyAppAssociation(appID int64, companyName string) error {
+	return InsertCompanyAppAssociationContext(context.Background(), appID, companyName)
+}
 
-	if !HasAppVersionID(appID) {
+// InsertCompanyAppAssociationContext is InsertCompanyAppAssociation, with its
+// queries cancelled when ctx is done.
+func InsertCompanyAppAssociationContext(ctx context.Context, appID int64, companyName string) error {
+
+	if !HasAppVersionIDContext(ctx, appID) {
 		util.Log.Warning("App ID: %d Not Found", appID)
 		return nil
 	}
 
-	if !HasCompanyName(companyName) {
+	if !HasCompanyNameContext(ctx, companyName) {
 		util.Log.Warning("Company Name %s Not Found", companyName)
 		return nil
 	}
 
-	if HasCompanyAppAssociation(appID, companyName) {
+	if HasCompanyAppAssociationContext(ctx, appID, companyName) {
 		util.Log.Debug("Company-App association between app: %d and company: %s already exists. Incrementing Count", appID, companyName)
-		return IncrementCompanyAppAssociationCount(appID, companyName)
+		return IncrementCompanyAppAssociationCountContext(ctx, appID, companyName)
 	}
 
-	rows, err := db.Query("insert into companyAppAssociations(company_name, associated_app, number_of_associations) values($1,$2,1)", companyName, appID)
-	rows.Close()
+	rows, err := db.QueryContext(ctx, "insert into companyAppAssociations(company_name, associated_app, number_of_associations) values($1,$2,1)", companyName, appID)
+	if rows != nil {
+		rows.Close()
+	}
 
 	if err != nil {
 		util.Log.Err("Error inserting company-app association for app with id: %d and company with name: %s. Error:", appID, companyName, err)
@@ -413,9 +651,15 @@ func InsertCompanyAppAssociation(appID int64, companyName string) error {
 
 // HasCompanyAppAssociation checks if an association between a given app and company name already exists.
 func HasCompanyAppAssociation(appID int64, companyName string) bool {
+	return HasCompanyAppAssociationContext(context.Background(), appID, companyName)
+}
+
+// HasCompanyAppAssociationContext is HasCompanyAppAssociation, with its queries
+// cancelled when ctx is done.
+func HasCompanyAppAssociationContext(ctx context.Context, appID int64, companyName string) bool {
 	var assocCount int
 	util.Log.Debug("Counting number of CompanyApp Assocications to see if it already exists.")
-	db.QueryRow("select count(*) from companyAppAssociations where company_name=$1 and associated_app=$2", companyName, appID).Scan(
+	db.QueryRowContext(ctx, "select count(*) from companyAppAssociations where company_name=$1 and associated_app=$2", companyName, appID).Scan(
 		&assocCount)
 	util.Log.Debug("Company-App Associations Counted. %d associations found for app with id: %d and company with name: %s", assocCount, appID, companyName)
 	return assocCount > 0
@@ -453,12 +697,18 @@ func SelectCompanyNames() ([]string, error) {
 
 // InsertCompanyName inserts the provided company name into the database.
 func InsertCompanyName(companyName string) error {
-	if HasCompanyName(companyName) {
+	return InsertCompanyNameContext(context.Background(), companyName)
+}
+
+// InsertCompanyNameContext is InsertCompanyName, with its queries cancelled
+// when ctx is done.
+func InsertCompanyNameContext(ctx context.Context, companyName string) error {
+	if HasCompanyNameContext(ctx, companyName) {
 		util.Log.Warning("Company Name: %s already exists. Exiting method.")
 		return nil
 	}
 
-	rows, err := db.Query("insert into companyNames(company_name) values( $1 )", companyName)
+	rows, err := db.QueryContext(ctx, "insert into companyNames(company_name) values( $1 )", companyName)
 	rows.Close()
 
 	if err != nil {
@@ -469,11 +719,381 @@ func InsertCompanyName(companyName string) error {
 	return nil
 }
 
+// InsertCompany inserts a company returned by the TrackerMapper API into the
+// database, returning its DB ID. Companies are unique by name and locale, so
+// inserting an existing company updates it instead.
+func InsertCompany(company TrackerMapperCompany) (int64, error) {
+	return InsertCompanyContext(context.Background(), company)
+}
+
+// InsertCompanyContext is InsertCompany, with its queries cancelled when ctx
+// is done.
+func InsertCompanyContext(ctx context.Context, company TrackerMapperCompany) (int64, error) {
+	if !useDB {
+		return 0, nil
+	}
+
+	var id int64
+	err := db.QueryRowContext(ctx,
+		`INSERT INTO tracker_companies(tm_id, name, locale, categories) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (name, locale) DO UPDATE SET tm_id = EXCLUDED.tm_id, categories = EXCLUDED.categories
+		RETURNING id`,
+		company.CompanyID, company.CompanyName, company.Locale, pq.Array(&company.Categories)).
+		Scan(&id)
+	if err != nil {
+		util.Log.Err("Error upserting TrackerMapper company %s: %s", company.CompanyName, err.Error())
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// AddAppCompany records that the app version with the given ID uses the
+// company with the given DB ID, because of the given host.
+func AddAppCompany(appID, companyID int64, host string) error {
+	return AddAppCompanyContext(context.Background(), appID, companyID, host)
+}
+
+// AddAppCompanyContext is AddAppCompany, with its queries cancelled when ctx
+// is done.
+func AddAppCompanyContext(ctx context.Context, appID, companyID int64, host string) error {
+	if !useDB || appID == 0 {
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx,
+		`INSERT INTO app_tracker_companies(app, company, host) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`,
+		appID, companyID, host)
+	if rows != nil {
+		rows.Close()
+	}
+	return err
+}
+
+// AppTrackerCompany records that an app version uses the TrackerMapper company
+// with the given name and locale, because of the given host.
+type AppTrackerCompany struct {
+	AppID  int64
+	Name   string
+	Locale string
+	Host   string
+}
+
+// minInt returns the smaller of a and b.
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// valuesList returns the placeholders for rows rows of cols values each,
+// e.g. "($1, $2), ($3, $4)".
+func valuesList(rows, cols int) string {
+	var b strings.Builder
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for j := 0; j < cols; j++ {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString("$" + strconv.Itoa(i*cols+j+1))
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// BatchInsertCompanies inserts TrackerMapper companies into the database,
+// using one statement per batch of companies. Companies that already exist are
+// left as they are.
+func BatchInsertCompanies(companies []TrackerMapperCompany) error {
+	return BatchInsertCompaniesContext(context.Background(), companies)
+}
+
+// BatchInsertCompaniesContext is BatchInsertCompanies, with its queries
+// cancelled when ctx is done.
+func BatchInsertCompaniesContext(ctx context.Context, companies []TrackerMapperCompany) error {
+	if !useDB {
+		return nil
+	}
+
+	for start := 0; start < len(companies); start += batchSize {
+		batch := companies[start:minInt(start+batchSize, len(companies))]
+		args := make([]interface{}, 0, len(batch)*4)
+		for i := range batch {
+			args = append(args, batch[i].CompanyID, batch[i].CompanyName, batch[i].Locale,
+				pq.Array(&batch[i].Categories))
+		}
+
+		rows, err := db.QueryContext(ctx,
+			`INSERT INTO tracker_companies(tm_id, name, locale, categories) VALUES `+
+				valuesList(len(batch), 4)+` ON CONFLICT (name, locale) DO NOTHING`,
+			args...)
+		if rows != nil {
+			rows.Close()
+		}
+		if err != nil {
+			util.Log.Err("Error inserting %d TrackerMapper companies: %s", len(batch), err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// BatchAddAppCompanies records app-company associations, using one statement
+// per batch of associations. The companies must already be in the database,
+// and associations with companies that aren't are skipped.
+func BatchAddAppCompanies(assocs []AppTrackerCompany) error {
+	return BatchAddAppCompaniesContext(context.Background(), assocs)
+}
+
+// BatchAddAppCompaniesContext is BatchAddAppCompanies, with its queries
+// cancelled when ctx is done.
+func BatchAddAppCompaniesContext(ctx context.Context, assocs []AppTrackerCompany) error {
+	if !useDB {
+		return nil
+	}
+
+	for start := 0; start < len(assocs); start += batchSize {
+		batch := assocs[start:minInt(start+batchSize, len(assocs))]
+		args := make([]interface{}, 0, len(batch)*4)
+		for _, a := range batch {
+			args = append(args, a.AppID, a.Name, a.Locale, a.Host)
+		}
+
+		rows, err := db.QueryContext(ctx,
+			`INSERT INTO app_tracker_companies(app, company, host)
+			SELECT v.app::int, c.id, v.host FROM (VALUES `+valuesList(len(batch), 4)+`) AS v(app, name, locale, host)
+			JOIN tracker_companies c ON c.name = v.name AND c.locale = v.locale
+			ON CONFLICT DO NOTHING`,
+			args...)
+		if rows != nil {
+			rows.Close()
+		}
+		if err != nil {
+			util.Log.Err("Error inserting %d app company associations: %s", len(batch), err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// CountUnmappedApps returns the number of apps with hosts, and how many of them
+// aren't associated with any TrackerMapper company.
+func CountUnmappedApps() (total, unmapped int64, err error) {
+	return CountUnmappedAppsContext(context.Background())
+}
+
+// CountUnmappedAppsContext is CountUnmappedApps, with its queries cancelled
+// when ctx is done.
+func CountUnmappedAppsContext(ctx context.Context) (total, unmapped int64, err error) {
+	err = db.QueryRowContext(ctx,
+		`SELECT count(*), count(*) FILTER (WHERE NOT EXISTS (
+			SELECT 1 FROM app_tracker_companies c WHERE c.app = h.id))
+		FROM app_hosts h`).Scan(&total, &unmapped)
+	return total, unmapped, err
+}
+
+// SetAppMapped records that host_mapper has mapped the hosts of the app with
+// the given ID at the current time.
+func SetAppMapped(appID int64) error {
+	return SetAppMappedContext(context.Background(), appID)
+}
+
+// SetAppMappedContext is SetAppMapped, with its queries cancelled when ctx is
+// done.
+func SetAppMappedContext(ctx context.Context, appID int64) error {
+	rows, err := db.QueryContext(ctx,
+		`INSERT INTO host_mapper_progress (app, mapped_at) VALUES ($1, $2)
+		ON CONFLICT (app) DO UPDATE SET mapped_at = EXCLUDED.mapped_at`, appID, time.Now())
+	if rows != nil {
+		rows.Close()
+	}
+	return err
+}
+
+// GetAppsMappedSince returns the IDs of the apps host_mapper has mapped since
+// the given time.
+func GetAppsMappedSince(since time.Time) (map[int64]util.Unit, error) {
+	return GetAppsMappedSinceContext(context.Background(), since)
+}
+
+// GetAppsMappedSinceContext is GetAppsMappedSince, with its queries cancelled
+// when ctx is done.
+func GetAppsMappedSinceContext(ctx context.Context, since time.Time) (map[int64]util.Unit, error) {
+	rows, err := db.QueryContext(ctx, "SELECT app FROM host_mapper_progress WHERE mapped_at >= $1", since)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[int64]util.Unit)
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = util.Unit{}
+	}
+	return ids, rows.Err()
+}
+
+// cleartextCols is the number of values of each row inserted by
+// AddCleartextHosts.
+const cleartextCols = 3
+
+// AddCleartextHosts records the hosts the app with the given ID contacts over
+// cleartext HTTP, as returned by util.App.CheckCleartext. Hosts already
+// recorded for the app have whether cleartext traffic to them is permitted
+// updated.
+func AddCleartextHosts(appID int64, hosts []util.CleartextHost) error {
+	return AddCleartextHostsContext(context.Background(), appID, hosts)
+}
+
+// AddCleartextHostsContext is AddCleartextHosts, with its queries cancelled
+// when ctx is done.
+func AddCleartextHostsContext(ctx context.Context, appID int64, hosts []util.CleartextHost) error {
+	if !useDB || appID == 0 {
+		return nil
+	}
+
+	size := minInt(batchSize, 65535/cleartextCols)
+	for start := 0; start < len(hosts); start += size {
+		batch := hosts[start:minInt(start+size, len(hosts))]
+		args := make([]interface{}, 0, len(batch)*cleartextCols)
+		for _, h := range batch {
+			args = append(args, appID, h.Host, h.Permitted)
+		}
+
+		rows, err := db.QueryContext(ctx,
+			`INSERT INTO app_cleartext_hosts(app, host, permitted)
+			SELECT v.app::int, v.host, v.permitted::bool
+			FROM (VALUES `+valuesList(len(batch), cleartextCols)+`) AS v(app, host, permitted)
+			ON CONFLICT (app, host) DO UPDATE SET permitted = EXCLUDED.permitted`,
+			args...)
+		if rows != nil {
+			rows.Close()
+		}
+		if err != nil {
+			util.Log.Err("Error inserting cleartext hosts of app %d: %s", appID, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// geoIPCols is the number of values of each row inserted by InsertGeoIP.
+const geoIPCols = 15
+
+// InsertGeoIP records the GeoIP info of the IPs host, one of the hosts of the
+// app with the given ID, resolved to, as returned by util.GetHostGeoIP. Info
+// already stored for the same app, host and IP is replaced, so InsertGeoIP can
+// be called again when a host is looked up again. Duplicate IPs in infos are
+// collapsed with util.DedupGeoIP.
+func InsertGeoIP(appID int64, host string, infos []util.GeoIPInfo) error {
+	return InsertGeoIPContext(context.Background(), appID, host, infos)
+}
+
+// InsertGeoIPContext is InsertGeoIP, with its queries cancelled when ctx is
+// done.
+func InsertGeoIPContext(ctx context.Context, appID int64, host string, infos []util.GeoIPInfo) error {
+	if !useDB {
+		return nil
+	}
+
+	infos = util.DedupGeoIP(infos)
+	size := minInt(batchSize, 65535/geoIPCols)
+	for start := 0; start < len(infos); start += size {
+		batch := infos[start:minInt(start+size, len(infos))]
+		args := make([]interface{}, 0, len(batch)*geoIPCols)
+		for _, inf := range batch {
+			args = append(args, appID, host, inf.IP, inf.CountryCode, inf.CountryName, inf.RegionCode,
+				inf.RegionName, inf.City, inf.ZipCode, inf.TimeZone, inf.Latitude, inf.Longitude,
+				inf.MetroCode, inf.ASN, inf.ASNOrg)
+		}
+
+		rows, err := db.QueryContext(ctx,
+			`INSERT INTO host_geoip(app, host, ip, country_code, country_name, region_code, region_name, city,
+				zip_code, time_zone, latitude, longitude, metro_code, asn, asn_org)
+			SELECT v.app::int, v.host, v.ip, NULLIF(v.cc, ''), NULLIF(v.country, ''), NULLIF(v.rc, ''),
+				NULLIF(v.region, ''), NULLIF(v.city, ''), NULLIF(v.zip, ''), NULLIF(v.tz, ''), v.lat::float8,
+				v.long::float8, NULLIF(v.metro::int, 0), NULLIF(v.asn::int, 0), NULLIF(v.asn_org, '')
+			FROM (VALUES `+valuesList(len(batch), geoIPCols)+`)
+				AS v(app, host, ip, cc, country, rc, region, city, zip, tz, lat, long, metro, asn, asn_org)
+			ON CONFLICT (app, host, ip) DO UPDATE SET country_code = EXCLUDED.country_code,
+				country_name = EXCLUDED.country_name, region_code = EXCLUDED.region_code,
+				region_name = EXCLUDED.region_name, city = EXCLUDED.city, zip_code = EXCLUDED.zip_code,
+				time_zone = EXCLUDED.time_zone, latitude = EXCLUDED.latitude, longitude = EXCLUDED.longitude,
+				metro_code = EXCLUDED.metro_code, asn = EXCLUDED.asn, asn_org = EXCLUDED.asn_org,
+				looked_up = now()`,
+			args...)
+		if rows != nil {
+			rows.Close()
+		}
+		if err != nil {
+			util.Log.Err("Error inserting GeoIP info of %s for app %d: %s", host, appID, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// GetGeoIPByApp returns the GeoIP info recorded with InsertGeoIP for the app
+// with the given ID, keyed by host. The reverse DNS names of the IPs aren't
+// stored, so PTR is never set.
+func GetGeoIPByApp(appID int64) (map[string][]util.GeoIPInfo, error) {
+	return GetGeoIPByAppContext(context.Background(), appID)
+}
+
+// GetGeoIPByAppContext is GetGeoIPByApp, with its queries cancelled when ctx
+// is done.
+func GetGeoIPByAppContext(ctx context.Context, appID int64) (map[string][]util.GeoIPInfo, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT host, ip, coalesce(country_code, ''), coalesce(country_name, ''), coalesce(region_code, ''),
+			coalesce(region_name, ''), coalesce(city, ''), coalesce(zip_code, ''), coalesce(time_zone, ''),
+			coalesce(latitude, 0), coalesce(longitude, 0), coalesce(metro_code, 0), coalesce(asn, 0),
+			coalesce(asn_org, '')
+		FROM host_geoip WHERE app = $1 ORDER BY host, ip`, appID)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string][]util.GeoIPInfo)
+	for rows.Next() {
+		var host string
+		var inf util.GeoIPInfo
+		err = rows.Scan(&host, &inf.IP, &inf.CountryCode, &inf.CountryName, &inf.RegionCode, &inf.RegionName,
+			&inf.City, &inf.ZipCode, &inf.TimeZone, &inf.Latitude, &inf.Longitude, &inf.MetroCode,
+			&inf.ASN, &inf.ASNOrg)
+		if err != nil {
+			return nil, err
+		}
+		ret[host] = append(ret[host], inf)
+	}
+	return ret, rows.Err()
+}
+
 // HasCompanyName Checks if companyNames table has the provided company name
 func HasCompanyName(companyName string) bool {
+	return HasCompanyNameContext(context.Background(), companyName)
+}
+
+// HasCompanyNameContext is HasCompanyName, with its queries cancelled when ctx
+// is done.
+func HasCompanyNameContext(ctx context.Context, companyName string) bool {
 	var companyCount int
 	util.Log.Debug("Requesting CompanyName Row for provided company name: %s", companyName)
-	db.QueryRow("select count(*) from companyNames where company_name=$1", companyName).Scan(
+	db.QueryRowContext(ctx, "select count(*) from companyNames where company_name=$1", companyName).Scan(
 		&companyCount)
 	util.Log.Debug("CompanyNames counted. %d companies found with name matching %s", companyCount, companyName)
 	return companyCount > 0
@@ -481,9 +1101,15 @@ func HasCompanyName(companyName string) bool {
 
 // HasAppVersionID Checks if app_versions table has the provided appversionId
 func HasAppVersionID(appID int64) bool {
+	return HasAppVersionIDContext(context.Background(), appID)
+}
+
+// HasAppVersionIDContext is HasAppVersionID, with its queries cancelled when
+// ctx is done.
+func HasAppVersionIDContext(ctx context.Context, appID int64) bool {
 	var appVerCount int
 	util.Log.Debug("Requesting app_version Row for provided app version id: %d", appID)
-	db.QueryRow("select count(*) from app_versions where id = $1", appID).Scan(
+	db.QueryRowContext(ctx, "select count(*) from app_versions where id = $1", appID).Scan(
 		&appVerCount)
 	util.Log.Debug("app_versions counted. %d app_versions found with ID matching %d", appVerCount, appID)
 	return appVerCount > 0
@@ -491,10 +1117,16 @@ func HasAppVersionID(appID int64) bool {
 
 // GetAppHostIDs returns an array of  app_version ids found in app_hosts.
 func GetAppHostIDs() ([]int64, error) {
+	return GetAppHostIDsContext(context.Background())
+}
+
+// GetAppHostIDsContext is GetAppHostIDs, with its queries cancelled when ctx is
+// done.
+func GetAppHostIDsContext(ctx context.Context) ([]int64, error) {
 	ids := make([]int64, 0, 0)
 
 	util.Log.Debug("About To request all app_host IDs.")
-	rows, err := db.Query("SELECT id FROM app_hosts")
+	rows, err := db.QueryContext(ctx, "SELECT id FROM app_hosts")
 
 	if rows != nil {
 		util.Log.Debug("Rows successfully Selected.")
@@ -506,9 +1138,13 @@ func GetAppHostIDs() ([]int64, error) {
 	}
 
 	util.Log.Debug("Scanning app_host ID rows.")
-	for i := 0; rows.Next(); i++ {
-		ids = append(ids, int64(i))
-		rows.Scan(&ids[i])
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			util.Log.Err("Error scanning app_hosts id: %s", err.Error())
+			return []int64{}, err
+		}
+		ids = append(ids, id)
 	}
 
 	if rows.Err() != sql.ErrNoRows && rows.Err() != nil {
@@ -31,6 +31,7 @@ create table app_versions(
   last_dl_attempt      timestamp                             ,
   icon                      text                             ,
   uses_reflect              bool                             ,
+  apk_sha256                text                             , -- Hex SHA-256 digest of the APK.
   last_analyze_attempt timestamp                             ,
   last_alt_checked     timestamp
 );
@@ -199,6 +200,74 @@ create table companyIoTDeviceAssociations(
   primary key (company_name, associated_iot_device)
 );
 
+--
+--    Companies returned by the TrackerMapper API, and the apps they were found
+--    in. host is the app host that was mapped to the company.
+--
+
+create table tracker_companies(
+  id                      serial      not null    primary key,
+  tm_id                   int                                 ,
+  name                    text        not null                ,
+  locale                  text        not null    default ''  ,
+  categories              text[]                              ,
+  unique (name, locale)
+);
+
+create table app_tracker_companies(
+  app                     int         not null    references app_versions(id),
+  company                 int         not null    references tracker_companies(id),
+  host                    text        not null    ,
+  primary key (app, company, host)
+);
+
+--
+--    GeoIP info of the IPs each app's hosts resolved to.
+--
+
+create table host_geoip(
+  app                     int           not null    references app_versions(id),
+  host                    text          not null    ,
+  ip                      text          not null    ,
+  country_code            text                      ,
+  country_name            text                      ,
+  region_code             text                      ,
+  region_name             text                      ,
+  city                    text                      ,
+  zip_code                text                      ,
+  time_zone               text                      ,
+  latitude                float8                    ,
+  longitude               float8                    ,
+  metro_code              int                       ,
+  asn                     int                       ,
+  asn_org                 text                      ,
+  looked_up               timestamp     not null    default now(),
+  primary key (app, host, ip)
+);
+
+create index host_geoip_country_code on host_geoip(country_code);
+
+--
+--    The hosts of http URLs found in each app, and whether its network
+--    configuration permits cleartext traffic to them.
+--
+
+create table app_cleartext_hosts(
+  app                     int           not null    references app_versions(id),
+  host                    text          not null    ,
+  permitted               bool          not null    ,
+  primary key (app, host)
+);
+
+--
+--    When host_mapper last mapped each app.
+--
+
+create table host_mapper_progress(
+  app                     int           primary key not null references app_versions(id),
+  mapped_at               timestamp     not null    default now()
+);
+
 create table companyWebsiteAssociations(
   id                      serial      not null    ,
   company_name            text        not null    references companyNames(company_name),
@@ -342,6 +411,12 @@ grant select, insert, update on app_perms to analyzer;
 grant select, insert, update on app_hosts to analyzer;
 grant select on companies to analyzer;
 grant select, insert, update on alt_apps to analyzer;
+grant select, insert, update on tracker_companies to analyzer;
+grant usage on tracker_companies_id_seq to analyzer;
+grant select, insert on app_tracker_companies to analyzer;
+grant select, insert, update on host_geoip to analyzer;
+grant select, insert, update on app_cleartext_hosts to analyzer;
+grant select, insert, update on host_mapper_progress to analyzer;
 
 grant select on apps to apiserv;
 grant select on app_versions to apiserv;
@@ -349,6 +424,8 @@ grant select on playstore_apps to apiserv;
 grant select on developers to apiserv;
 grant select on app_perms to apiserv;
 grant select on app_hosts to apiserv;
+grant select on host_geoip to apiserv;
+grant select on app_cleartext_hosts to apiserv;
 grant select on companies to apiserv;
 grant select on hosts to apiserv;
 grant select on alt_apps to apiserv;
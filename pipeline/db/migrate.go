@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sociam/xray-archiver/pipeline/util"
+)
+
+// migrations holds the schema migrations applied by Migrate. Each is named
+// <version>_<description>.sql and is applied once, in order of version.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrationLockID is the key of the advisory lock held while migrating, so
+// that programs starting at the same time don't apply a migration twice.
+const migrationLockID = 0x78726179
+
+// migration is a single schema migration.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations returns the embedded migrations ordered by version.
+func loadMigrations() ([]migration, error) {
+	files, err := migrations.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]migration, 0, len(files))
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), ".sql")
+		i := strings.Index(name, "_")
+		if i < 0 {
+			return nil, fmt.Errorf("migration %s isn't named <version>_<description>.sql", f.Name())
+		}
+		version, err := strconv.Atoi(name[:i])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has an invalid version: %s", f.Name(), err.Error())
+		}
+		data, err := migrations.ReadFile(path.Join("migrations", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, migration{version, name[i+1:], string(data)})
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].version < ret[j].version })
+	for i := 1; i < len(ret); i++ {
+		if ret[i].version == ret[i-1].version {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", ret[i-1].name, ret[i].name)
+		}
+	}
+	return ret, nil
+}
+
+// Migrate creates or upgrades the tables written to by the pipeline (the
+// company, app company, GeoIP, cleartext host and host_mapper progress tables,
+// along with the app tables they reference and the columns added to them) by
+// applying any migrations that haven't been applied yet. The applied versions are recorded in the schema_migrations
+// table, so Migrate can be run any number of times. Each migration is applied
+// in its own transaction. Roles and their permissions aren't set up; see
+// init_db.sql.
+func Migrate(ctx context.Context) error {
+	if !useDB || db.DB == nil {
+		return errors.New("database isn't open")
+	}
+
+	ms, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	// Advisory locks belong to a session, so keep to one connection.
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("couldn't lock the database for migrating: %s", err.Error())
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations(
+		version    int       PRIMARY KEY NOT NULL,
+		name       text      NOT NULL,
+		applied_at timestamp NOT NULL DEFAULT now())`)
+	if err != nil {
+		return fmt.Errorf("couldn't create schema_migrations: %s", err.Error())
+	}
+
+	applied := make(map[int]util.Unit)
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = util.Unit{}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+
+		util.Log.Info("Applying migration %d (%s)", m.version, m.name)
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %s", m.version, m.name, err.Error())
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+			m.version, m.name)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("couldn't record migration %d (%s): %s", m.version, m.name, err.Error())
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
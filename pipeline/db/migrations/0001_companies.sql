@@ -0,0 +1,144 @@
+-----
+--
+--  Tables written by host_mapper, along with the app tables they reference.
+--  Everything is created only if it doesn't exist yet, so this is a noop on
+--  databases set up with init_db.sql.
+--
+-----
+
+create table if not exists apps(
+  id        text primary key not null,
+  versions int[]
+);
+
+create table if not exists app_versions(
+  id                      serial         primary key not null,
+  app                       text references apps(id) not null,
+  store                     text                     not null,
+  region                    text                     not null,
+  version                   text                     not null,
+  apk_location              text                             , -- Path to the APK for this version of the App.
+  apk_filesystem            text                             ,
+  apk_filesystem_name       text                             ,
+  apk_location_root         text                             ,
+  apk_location_uuid         text                             , -- UUID of the device that this APK is stored on.
+  apk_server_location       text                             , -- Really an indicator of what VM the APK is stored on.
+  screen_flags               int                             ,
+  downloaded                bool                     not null,
+  apk_archived              bool                     default false,
+  has_apk_stored            bool                     default false,
+  analyzed                  bool                     not null,
+  last_dl_attempt      timestamp                             ,
+  icon                      text                             ,
+  uses_reflect              bool                             ,
+  apk_sha256                text                             , -- Hex SHA-256 digest of the APK.
+  last_analyze_attempt timestamp                             ,
+  last_alt_checked     timestamp
+);
+
+create table if not exists app_hosts(
+  id       int references app_versions(id) primary key not null,
+  hosts text[]                                                 ,
+  pis    int[]
+);
+
+create table if not exists app_companies(
+  id         int references app_versions(id) primary key not null,
+  companies  text[]
+);
+
+create table if not exists companies(
+  id             text     primary key not null,
+  name           text                 not null,
+  hosts         int[]                         ,
+  founded        text                         ,
+  acquired       text                         ,
+  type         text[]                         ,
+  typetag        text                         ,
+  jurisdiction   text                         ,
+  parent         text references companies(id),
+  capital        text                         ,
+  equity         text                         ,
+  min_size        int                         ,
+  max_size        int                         ,
+  data_sources text[]                         ,
+  description    text
+);
+
+create table if not exists companyNames(
+  id                      serial      not null    primary key,
+  company_name            text        not null    unique
+);
+
+create table if not exists companyAssociations(
+  id                      serial      not null    primary key,
+  company_name            text        not null    unique references companyNames(company_name),
+  app_associations        int[],
+  iot_device_associations int[],
+  website_associations    int[]
+);
+
+create table if not exists companyAppAssociations(
+  id                      serial      not null    ,
+  company_name            text        not null    references companyNames(company_name),
+  associated_app          serial      not null    references app_versions(id),
+  primary key (company_name, associated_app)
+);
+
+create table if not exists tracker_companies(
+  id                      serial      not null    primary key,
+  tm_id                   int                                 ,
+  name                    text        not null                ,
+  locale                  text        not null    default ''  ,
+  categories              text[]                              ,
+  unique (name, locale)
+);
+
+create table if not exists app_tracker_companies(
+  app                     int         not null    references app_versions(id),
+  company                 int         not null    references tracker_companies(id),
+  host                    text        not null    ,
+  primary key (app, company, host)
+);
+
+create or replace function createCompanyAssociationRecord() returns trigger as
+  $BODY$
+    begin
+      insert into companyAssociations(
+        company_name,
+        app_associations,
+        iot_device_associations,
+        website_associations
+      ) values (
+        new.company_name,
+        array[]::integer[],
+        array[]::integer[],
+        array[]::integer[]
+      );
+      return new;
+    end;
+  $BODY$
+language plpgsql;
+
+create or replace function updateCompanyAppAssociations() returns trigger as
+  $BODY$
+    begin
+      update companyAssociations
+        set app_associations = app_associations || new.associated_app
+          where company_name = new.company_name;
+      return new;
+    end;
+  $BODY$
+language plpgsql;
+
+drop trigger if exists onCompanyNameInsert on companyNames;
+create trigger onCompanyNameInsert
+  after insert on companyNames
+    for each row
+      execute procedure createCompanyAssociationRecord();
+
+drop trigger if exists onCompanyAppAssociationInsert on companyAppAssociations;
+create trigger onCompanyAppAssociationInsert
+  after insert on companyAppAssociations
+    for each row
+      execute procedure updateCompanyAppAssociations();
@@ -0,0 +1,25 @@
+-----
+--
+--  GeoIP info of the IPs app hosts resolved to, as returned by
+--  util.GetHostGeoIP.
+--
+-----
+
+create table if not exists host_geoip(
+  host                    text          not null    ,
+  ip                      text          not null    ,
+  country_code            text                      ,
+  country_name            text                      ,
+  region_code             text                      ,
+  region_name             text                      ,
+  city                    text                      ,
+  zip_code                text                      ,
+  time_zone               text                      ,
+  latitude                float8                    ,
+  longitude               float8                    ,
+  metro_code              int                       ,
+  looked_up               timestamp     not null    default now(),
+  primary key (host, ip)
+);
+
+create index if not exists host_geoip_country_code on host_geoip(country_code);
@@ -0,0 +1,19 @@
+-----
+--
+--  The autonomous system of each IP in host_geoip. Postgres 9.5 has no add
+--  column if not exists, so information_schema is checked instead.
+--
+-----
+
+do $$
+begin
+  if not exists (select 1 from information_schema.columns
+                 where table_schema = current_schema() and table_name = 'host_geoip' and column_name = 'asn') then
+    alter table host_geoip add column asn int;
+  end if;
+  if not exists (select 1 from information_schema.columns
+                 where table_schema = current_schema() and table_name = 'host_geoip' and column_name = 'asn_org') then
+    alter table host_geoip add column asn_org text;
+  end if;
+end
+$$;
@@ -0,0 +1,11 @@
+-----
+--
+--  When host_mapper last mapped each app, so that interrupted runs can be
+--  resumed with -resume.
+--
+-----
+
+create table if not exists host_mapper_progress(
+  app                     int           primary key not null references app_versions(id),
+  mapped_at               timestamp     not null    default now()
+);
@@ -0,0 +1,18 @@
+-----
+--
+--  Key host_geoip by app as well, as written by db.InsertGeoIP. Rows from
+--  before then can't be attributed to an app, and are dropped.
+--
+-----
+
+do $$
+begin
+  if not exists (select 1 from information_schema.columns
+                 where table_schema = current_schema() and table_name = 'host_geoip' and column_name = 'app') then
+    delete from host_geoip;
+    alter table host_geoip add column app int not null references app_versions(id);
+    alter table host_geoip drop constraint host_geoip_pkey;
+    alter table host_geoip add primary key (app, host, ip);
+  end if;
+end
+$$;
@@ -0,0 +1,16 @@
+-----
+--
+--  The APK digest added to app_versions, for databases set up with an
+--  init_db.sql from before it was. Postgres 9.5 has no add column if not
+--  exists, so information_schema is checked instead.
+--
+-----
+
+do $$
+begin
+  if not exists (select 1 from information_schema.columns
+                 where table_schema = current_schema() and table_name = 'app_versions' and column_name = 'apk_sha256') then
+    alter table app_versions add column apk_sha256 text;
+  end if;
+end
+$$;
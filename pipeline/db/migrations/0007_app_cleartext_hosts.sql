@@ -0,0 +1,13 @@
+-----
+--
+--  The hosts each app contacts over cleartext HTTP, as written by
+--  db.AddCleartextHosts.
+--
+-----
+
+create table if not exists app_cleartext_hosts(
+  app                     int           not null    references app_versions(id),
+  host                    text          not null    ,
+  permitted               bool          not null    ,
+  primary key (app, host)
+);
@@ -153,15 +153,19 @@ func (a AppVersion) UtilApp() *util.App {
 	return util.NewApp(a.ID, a.App, a.Store, a.Region, a.Ver, a.APKLocationPath, a.APKLocationRoot, a.APKLocationUUID)
 }
 
-// AppHostRecord holds app_host data from the xray DB
+// AppHostRecord holds app_host data from the xray DB, along with the region of
+// the app version.
 type AppHostRecord struct {
 	ID        int64    `json:"id"`
 	HostNames []string `json:"hostnames"`
+	Region    string   `json:"region"`
 }
 
 // TrackerMapperRequest holds the data used in requests to the OxfordHCC TrackerMapper API.
+// Locale is the region of the app the hosts belong to, if known.
 type TrackerMapperRequest struct {
 	HostNames []string `json:"host_names"`
+	Locale    string   `json:"locale,omitempty"`
 }
 
 // TrackerMapperCompany holds the data requested from the OxfordHCC TrackerMapper API.
@@ -0,0 +1,179 @@
+package util
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NativeLibs returns the native libraries shipped in the unpacked app, as a
+// map of ABI (e.g. armeabi-v7a, arm64-v8a, x86, x86_64) to the names of the
+// .so files for that ABI. It must be called after Unpack. Apps without native
+// code have an empty map.
+func (app *App) NativeLibs() (map[string][]string, error) {
+	libs := make(map[string][]string)
+
+	libDir := path.Join(app.OutDir(), "lib")
+	abis, err := ioutil.ReadDir(libDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return libs, nil
+		}
+		return nil, err
+	}
+
+	for _, abi := range abis {
+		if !abi.IsDir() {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(path.Join(libDir, abi.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, 0, len(files))
+		for _, f := range files {
+			if !f.IsDir() && strings.HasSuffix(f.Name(), ".so") {
+				names = append(names, f.Name())
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			libs[abi.Name()] = names
+		}
+	}
+
+	return libs, nil
+}
+
+// ListEntries returns the names of the files in the app's APK, in the order
+// they are stored, without unpacking it.
+func (app *App) ListEntries() ([]string, error) {
+	r, err := zip.OpenReader(app.ApkPath())
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	names := make([]string, 0, len(r.File))
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	return names, nil
+}
+
+// CertInfo describes a certificate an APK was signed with.
+type CertInfo struct {
+	// File is the signature block in the APK the certificate was found in,
+	// e.g. META-INF/CERT.RSA.
+	File      string    `json:"file"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	// SHA256 is the hex encoded SHA-256 fingerprint of the certificate.
+	SHA256 string `json:"sha256"`
+}
+
+// pkcs7ContentInfo and pkcs7SignedData are the parts of the PKCS#7 structures
+// (RFC 2315) in a signature block needed to get at its certificates.
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	// Content is the [0] EXPLICIT wrapper, so its Bytes are the SignedData.
+	Content asn1.RawValue
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+// isSignatureBlock reports whether name is a v1 (JAR) signature block.
+func isSignatureBlock(name string) bool {
+	if path.Dir(name) != "META-INF" {
+		return false
+	}
+	switch strings.ToUpper(path.Ext(name)) {
+	case ".RSA", ".DSA", ".EC":
+		return true
+	}
+	return false
+}
+
+// SigningCerts returns the certificates in the v1 signature blocks of the
+// app's APK, i.e. the META-INF/*.RSA, *.DSA and *.EC files. APKs that are only
+// signed using the v2 or v3 schemes have none.
+//
+// TODO: parse the APK Signing Block used by the v2 and v3 signature schemes.
+func (app *App) SigningCerts() ([]CertInfo, error) {
+	r, err := zip.OpenReader(app.ApkPath())
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var certs []CertInfo
+	for _, f := range r.File {
+		if !isSignatureBlock(f.Name) {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		block, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		parsed, err := parsePKCS7Certs(block)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse signature block %s: %s", f.Name, err.Error())
+		}
+		for _, cert := range parsed {
+			fingerprint := sha256.Sum256(cert.Raw)
+			certs = append(certs, CertInfo{
+				File:      f.Name,
+				Issuer:    cert.Issuer.String(),
+				Subject:   cert.Subject.String(),
+				Serial:    cert.SerialNumber.String(),
+				NotBefore: cert.NotBefore,
+				NotAfter:  cert.NotAfter,
+				SHA256:    hex.EncodeToString(fingerprint[:]),
+			})
+		}
+	}
+	return certs, nil
+}
+
+// parsePKCS7Certs returns the certificates in a DER encoded PKCS#7 SignedData
+// structure.
+func parsePKCS7Certs(der []byte) ([]*x509.Certificate, error) {
+	var info pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+
+	var signed pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &signed); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificates(signed.Certificates.Bytes)
+}
@@ -0,0 +1,146 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minApktoolVersion is the oldest apktool that CheckApktool accepts.
+var minApktoolVersion = [3]int{2, 0, 0}
+
+// forceManifestVersion is the first apktool with --force-manifest, which
+// decodes AndroidManifest.xml even with --no-res.
+var forceManifestVersion = [3]int{2, 5, 0}
+
+var apktoolVersionRe = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// resourceErrorRe matches the output of apktool failing to decode an APK's
+// resources, rather than its manifest or the APK itself.
+var resourceErrorRe = regexp.MustCompile(`(?i)could not decode (?:arsc|res)|brut\.androlib\.res\.|UndefinedResObject|resources\.arsc`)
+
+// frameworkErrorRe matches the output of apktool failing to decode an APK
+// because the framework resources it references aren't installed, capturing
+// the ID of the framework package.
+var frameworkErrorRe = regexp.MustCompile(`(?i)(?:can't|can ?not|could not) find framework resources for package of id: (\d+)`)
+
+// ErrFrameworkMissing is returned (wrapped) by Unpack when apktool needs
+// framework resources that haven't been installed with InstallFramework.
+var ErrFrameworkMissing = errors.New("apktool framework not installed")
+
+var (
+	apktoolMu      sync.Mutex
+	apktoolVersion string
+)
+
+// parseApktoolVersion extracts the major, minor and patch version from the
+// output of apktool --version, e.g. "2.4.1" or "v2.3.4-dirty".
+func parseApktoolVersion(out string) ([3]int, error) {
+	var v [3]int
+	m := apktoolVersionRe.FindStringSubmatch(out)
+	if m == nil {
+		return v, fmt.Errorf("couldn't find a version in %q", out)
+	}
+	for i := range v {
+		if m[i+1] != "" {
+			v[i], _ = strconv.Atoi(m[i+1])
+		}
+	}
+	return v, nil
+}
+
+// versionLess reports whether version a is older than b.
+func versionLess(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// CheckApktool runs Cfg.ApktoolPath --version, returning the version of
+// apktool, or an error if it can't be run or is older than 2.0.0. The version
+// is then also returned by ApktoolVersion.
+func CheckApktool() (string, error) {
+	out, err := exec.Command(Cfg.ApktoolPath, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("couldn't run %s --version: %s", Cfg.ApktoolPath, err.Error())
+	}
+
+	version := strings.TrimSpace(string(out))
+	v, err := parseApktoolVersion(version)
+	if err != nil {
+		return "", err
+	}
+	if versionLess(v, minApktoolVersion) {
+		return "", fmt.Errorf("apktool %s is too old, at least %d.%d.%d is required",
+			version, minApktoolVersion[0], minApktoolVersion[1], minApktoolVersion[2])
+	}
+
+	apktoolMu.Lock()
+	apktoolVersion = version
+	apktoolMu.Unlock()
+	return version, nil
+}
+
+// ApktoolVersion returns the apktool version found by CheckApktool, or the
+// empty string if it hasn't been called.
+func ApktoolVersion() string {
+	apktoolMu.Lock()
+	defer apktoolMu.Unlock()
+	return apktoolVersion
+}
+
+// frameworkArgs returns the arguments making apktool use the frameworks in
+// Cfg.FrameworkDir, if it is set, rather than its default framework
+// directory.
+func frameworkArgs() []string {
+	if Cfg.FrameworkDir == "" {
+		return nil
+	}
+	return []string{"-p", Cfg.FrameworkDir}
+}
+
+// InstallFramework installs the framework resources in the APK at apkPath,
+// such as a device's framework-res.apk, with apktool if, so that apps using
+// them can be unpacked. They are installed in Cfg.FrameworkDir if it is set.
+func InstallFramework(apkPath string) error {
+	args := append([]string{"if", apkPath}, frameworkArgs()...)
+	out, err := exec.Command(Cfg.ApktoolPath, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("couldn't install framework %s: %s; output below:\n%s", apkPath, err.Error(), out)
+	}
+	return nil
+}
+
+// frameworkError returns an error wrapping ErrFrameworkMissing if the apktool
+// output out shows that it failed to decode apkPath because a framework isn't
+// installed, and nil otherwise.
+func frameworkError(apkPath string, out []byte) error {
+	m := frameworkErrorRe.FindSubmatch(out)
+	if m == nil {
+		return nil
+	}
+	dir := Cfg.FrameworkDir
+	if dir == "" {
+		dir = "apktool's default framework directory"
+	}
+	return fmt.Errorf("%w: %s needs the resources of framework package %s; install the framework APK "+
+		"it was built against (e.g. framework-res.apk or a vendor framework from the device) in %s "+
+		"with `analyzer install-framework <apk>`", ErrFrameworkMissing, apkPath, m[1], dir)
+}
+
+// noResArgs returns the arguments making apktool skip decoding resources. The
+// manifest is still decoded if the apktool found by CheckApktool supports it.
+func noResArgs() []string {
+	args := []string{"--no-res"}
+	if v, err := parseApktoolVersion(ApktoolVersion()); err == nil && !versionLess(v, forceManifestVersion) {
+		args = append(args, "--force-manifest")
+	}
+	return args
+}
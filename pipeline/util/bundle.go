@@ -0,0 +1,79 @@
+package util
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// IsBundle reports whether the file at p is an Android App Bundle, which has
+// to be converted to an APK before apktool can decode it.
+func IsBundle(p string) bool {
+	return strings.EqualFold(path.Ext(p), ".aab")
+}
+
+// buildUniversalAPK uses bundletool to build a universal APK from the bundle
+// at aabPath. The APK is written to workDir and its path returned.
+func buildUniversalAPK(ctx context.Context, aabPath, workDir string) (string, error) {
+	bundletool, err := exec.LookPath(Cfg.BundletoolPath)
+	if err != nil {
+		return "", fmt.Errorf("bundletool (%s) is required to unpack app bundles but couldn't be found: %s",
+			Cfg.BundletoolPath, err.Error())
+	}
+
+	apksPath := path.Join(workDir, "universal.apks")
+	cmd := exec.CommandContext(ctx, bundletool, "build-apks", "--mode=universal",
+		"--bundle="+aabPath, "--output="+apksPath, "--overwrite")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("%s building universal apk; output below:\n%s",
+			err.Error(), string(out))
+	}
+
+	// The .apks file is a zip archive containing universal.apk.
+	apks, err := zip.OpenReader(apksPath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't open %s: %s", apksPath, err.Error())
+	}
+	defer apks.Close()
+
+	for _, f := range apks.File {
+		if path.Base(f.Name) != "universal.apk" {
+			continue
+		}
+
+		apkPath := path.Join(workDir, "universal.apk")
+		if err = extractZipFile(f, apkPath); err != nil {
+			return "", err
+		}
+		return apkPath, nil
+	}
+	return "", fmt.Errorf("bundletool output %s has no universal.apk", apksPath)
+}
+
+// extractZipFile writes the contents of f to dest.
+func extractZipFile(f *zip.File, dest string) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,169 @@
+package util
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// CleartextHost is a host of an http URL found in an app, along with whether
+// the app's network configuration allows cleartext traffic to it.
+type CleartextHost struct {
+	Host      string `json:"host"`
+	Permitted bool   `json:"permitted"`
+}
+
+// manifestNetwork holds the network configuration of an AndroidManifest.xml.
+type manifestNetwork struct {
+	Application struct {
+		UsesCleartextTraffic  string `xml:"usesCleartextTraffic,attr"`
+		NetworkSecurityConfig string `xml:"networkSecurityConfig,attr"`
+	} `xml:"application"`
+}
+
+// networkSecurityConfig is a network security config XML resource.
+type networkSecurityConfig struct {
+	Base *struct {
+		Cleartext string `xml:"cleartextTrafficPermitted,attr"`
+	} `xml:"base-config"`
+	Domains []nscDomainConfig `xml:"domain-config"`
+}
+
+// nscDomainConfig is a domain-config element, which may be nested in another
+// one whose settings it inherits.
+type nscDomainConfig struct {
+	Cleartext string `xml:"cleartextTrafficPermitted,attr"`
+	Domains   []struct {
+		IncludeSubdomains string `xml:"includeSubdomains,attr"`
+		Name              string `xml:",chardata"`
+	} `xml:"domain"`
+	Children []nscDomainConfig `xml:"domain-config"`
+}
+
+// cleartextRule is whether cleartext traffic to a domain, and optionally its
+// subdomains, is permitted.
+type cleartextRule struct {
+	domain            string
+	includeSubdomains bool
+	permitted         bool
+}
+
+// cleartextPolicy decides whether cleartext traffic to a host is permitted.
+type cleartextPolicy struct {
+	base  bool
+	rules []cleartextRule
+}
+
+// permitted applies the rule for the most specific domain matching host,
+// where an exact match takes precedence over subdomains of a longer domain,
+// as on Android.
+func (p cleartextPolicy) permitted(host string) bool {
+	var best *cleartextRule
+	for i, rule := range p.rules {
+		if rule.domain == host {
+			return rule.permitted
+		}
+		if rule.includeSubdomains && strings.HasSuffix(host, "."+rule.domain) &&
+			(best == nil || len(rule.domain) > len(best.domain)) {
+			best = &p.rules[i]
+		}
+	}
+	if best != nil {
+		return best.permitted
+	}
+	return p.base
+}
+
+// addRules adds the rules of the domain-config configs to p, inheriting
+// whether cleartext is permitted from the enclosing config.
+func (p *cleartextPolicy) addRules(configs []nscDomainConfig, inherited bool) {
+	for _, config := range configs {
+		permitted := inherited
+		if config.Cleartext != "" {
+			permitted = config.Cleartext == "true"
+		}
+		for _, domain := range config.Domains {
+			p.rules = append(p.rules, cleartextRule{
+				domain:            NormalizeHost(domain.Name),
+				includeSubdomains: domain.IncludeSubdomains == "true",
+				permitted:         permitted,
+			})
+		}
+		p.addRules(config.Children, permitted)
+	}
+}
+
+// cleartextPolicy reads the unpacked app's network configuration. Cleartext
+// traffic is permitted by default to apps targeting SDKs before 28, unless
+// the manifest sets usesCleartextTraffic. A network security config overrides
+// both, as it does since Android 7.0.
+func (app *App) cleartextPolicy() (cleartextPolicy, error) {
+	_, _, _, targetSdk, err := app.ManifestInfo()
+	if err != nil {
+		return cleartextPolicy{}, err
+	}
+	data, err := app.readManifest()
+	if err != nil {
+		return cleartextPolicy{}, err
+	}
+	var manifest manifestNetwork
+	if err = xml.Unmarshal(data, &manifest); err != nil {
+		return cleartextPolicy{}, fmt.Errorf("couldn't parse manifest: %s", err.Error())
+	}
+
+	policy := cleartextPolicy{base: targetSdk < 28}
+	if attr := manifest.Application.UsesCleartextTraffic; attr != "" {
+		policy.base = attr == "true"
+	}
+
+	ref := manifest.Application.NetworkSecurityConfig
+	if !strings.HasPrefix(ref, "@xml/") {
+		return policy, nil
+	}
+	fname := path.Join(app.OutDir(), "res", "xml", strings.TrimPrefix(ref, "@xml/")+".xml")
+	nscData, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if app.ResourcesUndecoded {
+				return policy, fmt.Errorf("network security config %s wasn't decoded", ref)
+			}
+			return policy, fmt.Errorf("network security config %s not found", ref)
+		}
+		return policy, err
+	}
+	var nsc networkSecurityConfig
+	if err = xml.Unmarshal(nscData, &nsc); err != nil {
+		return policy, fmt.Errorf("couldn't parse network security config: %s", err.Error())
+	}
+
+	policy.base = targetSdk < 28
+	if nsc.Base != nil && nsc.Base.Cleartext != "" {
+		policy.base = nsc.Base.Cleartext == "true"
+	}
+	policy.addRules(nsc.Domains, policy.base)
+	return policy, nil
+}
+
+// CheckCleartext reports, for each of the app's CleartextHosts, whether its
+// usesCleartextTraffic setting and network security config allow it to be
+// contacted without TLS. A host the config doesn't permit cleartext traffic
+// to is still worth reporting, as the URL may be upgraded or the check
+// bypassed by a networking library. It must be called after ExtractHosts.
+func (app *App) CheckCleartext() ([]CleartextHost, error) {
+	if len(app.CleartextHosts) == 0 {
+		return nil, nil
+	}
+	policy, err := app.cleartextPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]CleartextHost, 0, len(app.CleartextHosts))
+	for _, host := range app.CleartextHosts {
+		ret = append(ret, CleartextHost{host, policy.permitted(host)})
+	}
+	return ret, nil
+}
@@ -0,0 +1,174 @@
+package util
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// manifestComponents holds the components declared in an
+// AndroidManifest.xml.
+type manifestComponents struct {
+	Package     string `xml:"package,attr"`
+	Application struct {
+		Permission string              `xml:"permission,attr"`
+		Activities []manifestComponent `xml:"activity"`
+		Aliases    []manifestComponent `xml:"activity-alias"`
+		Services   []manifestComponent `xml:"service"`
+		Receivers  []manifestComponent `xml:"receiver"`
+		Providers  []manifestComponent `xml:"provider"`
+	} `xml:"application"`
+}
+
+// manifestComponent is an <activity>, <activity-alias>, <service>,
+// <receiver> or <provider> element.
+type manifestComponent struct {
+	Name            string     `xml:"name,attr"`
+	Exported        string     `xml:"exported,attr"`
+	Permission      string     `xml:"permission,attr"`
+	ReadPermission  string     `xml:"readPermission,attr"`
+	WritePermission string     `xml:"writePermission,attr"`
+	IntentFilters   []xml.Name `xml:"intent-filter"`
+}
+
+// Component is an activity, service, broadcast receiver or content provider
+// declared in an app's manifest.
+type Component struct {
+	// Name is the fully qualified class name of the component, or of the
+	// alias for activity aliases.
+	Name string `json:"name"`
+	// Exported is whether other apps can start or bind to the component,
+	// whether it is set explicitly or implied by the rules described on
+	// Components.
+	Exported bool `json:"exported"`
+	// Permission is the permission other apps must hold to use the component,
+	// which for providers covers both reading and writing. ReadPermission and
+	// WritePermission are those of providers that set them separately.
+	Permission      string `json:"permission,omitempty"`
+	ReadPermission  string `json:"readPermission,omitempty"`
+	WritePermission string `json:"writePermission,omitempty"`
+}
+
+// Guarded reports whether other apps need a permission to use every part of
+// the component.
+func (c Component) Guarded() bool {
+	return c.Permission != "" || (c.ReadPermission != "" && c.WritePermission != "")
+}
+
+// Components are the components declared in an app's manifest, by kind.
+// Activity aliases are included in Activities.
+type Components struct {
+	Activities []Component `json:"activities"`
+	Services   []Component `json:"services"`
+	Receivers  []Component `json:"receivers"`
+	Providers  []Component `json:"providers"`
+}
+
+// Unguarded returns the exported components other apps can use without
+// holding any permission, which make up the app's attack surface.
+func (c Components) Unguarded() []Component {
+	var unguarded []Component
+	for _, kind := range [][]Component{c.Activities, c.Services, c.Receivers, c.Providers} {
+		for _, comp := range kind {
+			if comp.Exported && !comp.Guarded() {
+				unguarded = append(unguarded, comp)
+			}
+		}
+	}
+	return unguarded
+}
+
+// Components returns the components declared in the manifests of the app and
+// its Splits. It must be called after Unpack.
+//
+// Components without an android:exported attribute are exported as Android
+// would: activities, services and receivers are exported if they have an
+// intent filter and the app targets an SDK before 31, which made the
+// attribute mandatory for them, and providers are exported if the app
+// targets SDK 16 or earlier. Components without a permission of their own are
+// guarded by that of the application, if it sets one.
+func (app *App) Components() (Components, error) {
+	_, _, _, targetSdk, err := app.ManifestInfo()
+	if err != nil {
+		return Components{}, err
+	}
+
+	data, err := app.readManifest()
+	if err != nil {
+		return Components{}, err
+	}
+	comps, err := manifestComponentsOf(data, targetSdk)
+	if err != nil {
+		return Components{}, err
+	}
+
+	for _, split := range app.Splits {
+		data, err := readManifestIn(app.SplitDir(split))
+		if err != nil {
+			return Components{}, fmt.Errorf("split %s: %s", SplitName(split), err.Error())
+		}
+		splitComps, err := manifestComponentsOf(data, targetSdk)
+		if err != nil {
+			return Components{}, fmt.Errorf("split %s: %s", SplitName(split), err.Error())
+		}
+		comps.Activities = append(comps.Activities, splitComps.Activities...)
+		comps.Services = append(comps.Services, splitComps.Services...)
+		comps.Receivers = append(comps.Receivers, splitComps.Receivers...)
+		comps.Providers = append(comps.Providers, splitComps.Providers...)
+	}
+	return comps, nil
+}
+
+// manifestComponentsOf returns the components declared in the decoded
+// manifest data of an app targeting targetSdk.
+func manifestComponentsOf(data []byte, targetSdk int) (Components, error) {
+	var manifest manifestComponents
+	if err := xml.Unmarshal(data, &manifest); err != nil {
+		return Components{}, fmt.Errorf("couldn't parse manifest: %s", err.Error())
+	}
+
+	application := manifest.Application
+	convert := func(elems []manifestComponent, provider bool) []Component {
+		comps := make([]Component, 0, len(elems))
+		for _, elem := range elems {
+			comp := Component{
+				Name:            componentName(manifest.Package, elem.Name),
+				Permission:      elem.Permission,
+				ReadPermission:  elem.ReadPermission,
+				WritePermission: elem.WritePermission,
+			}
+			switch {
+			case elem.Exported != "":
+				comp.Exported = elem.Exported == "true"
+			case provider:
+				comp.Exported = targetSdk <= 16
+			default:
+				comp.Exported = len(elem.IntentFilters) > 0 && targetSdk < 31
+			}
+			if comp.Permission == "" {
+				comp.Permission = application.Permission
+			}
+			comps = append(comps, comp)
+		}
+		return comps
+	}
+
+	return Components{
+		Activities: convert(append(application.Activities, application.Aliases...), false),
+		Services:   convert(application.Services, false),
+		Receivers:  convert(application.Receivers, false),
+		Providers:  convert(application.Providers, true),
+	}, nil
+}
+
+// componentName qualifies the class name of a component, which may be given
+// relative to the manifest's package, e.g. ".MainActivity".
+func componentName(pkg, name string) string {
+	if strings.HasPrefix(name, ".") {
+		return pkg + name
+	}
+	if !strings.Contains(name, ".") {
+		return pkg + "." + name
+	}
+	return name
+}
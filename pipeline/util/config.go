@@ -1,14 +1,33 @@
 package util
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// defaultDBBatchSize is used when the config doesn't specify db.batch_size.
+const defaultDBBatchSize = 500
+
+// defaultDBConnectWait is used when the config doesn't specify
+// db.connect_wait.
+const defaultDBConnectWait = time.Minute
+
+// defaultSockPath is used when the config doesn't specify sockpath.
+const defaultSockPath = "/var/run/apkScraper"
+
 // DBCfg Struct for the Database Config File information
 type DBCfg struct {
 	Database string `json:"database"`
@@ -16,6 +35,15 @@ type DBCfg struct {
 	Password string `json:"-"`
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
+
+	// BatchSize is the maximum number of rows inserted at once by the db
+	// package's Batch* functions.
+	BatchSize int `json:"batch_size"`
+
+	// ConnectWait is how long programs wait for the database to become
+	// reachable when starting. It is parsed from RawConnectWait, e.g. "1m".
+	ConnectWait    time.Duration `json:"-"`
+	RawConnectWait string        `json:"connect_wait"`
 }
 
 // DBCreds Struct for the Database Credentials
@@ -36,16 +64,192 @@ type APIServCfg struct {
 	DB DBCreds `json:"db"`
 }
 
+// NodeCfg Represents the Credentials used to connect to the DB as one of the
+// Node.js programs sharing the config file. They aren't used by the Go
+// programs, but are declared so that the file is accepted by Load.
+type NodeCfg struct {
+	DB DBCreds `json:"db"`
+}
+
+// TrackerMapper backends selectable with the tracker_mapper.backend config
+// option.
+const (
+	TrackerMapperBackendHTTP = "http"
+	TrackerMapperBackendFile = "file"
+)
+
+// TrackerMapperCfg holds the config relating to mapping hosts to companies.
+// Backend is either "http", the OxfordHCC TrackerMapper API at URL, or "file",
+// the local JSON or CSV rules file at Path. Workers is the number of apps
+// host_mapper maps at once, and RateLimit the maximum number of lookups per
+// second, or 0 for no limit.
+type TrackerMapperCfg struct {
+	Backend   string  `json:"backend"`
+	URL       string  `json:"url"`
+	Path      string  `json:"path"`
+	Workers   int     `json:"workers"`
+	RateLimit float64 `json:"rate_limit"`
+}
+
+// GeoIPCfg selects the backend used to look up GeoIP info: either "http",
+// the service at GeoIPEndpoint, or "mmdb", the local MaxMind database at
+// MMDBPath. The mmdb backend also looks up the ASN of each IP in the MaxMind
+// ASN database at ASNMMDBPath, if it is set. ReverseDNS additionally looks up
+// the PTR records of each IP. IPFamily restricts the addresses of hosts looked
+// up to "v4" or "v6" ones, so that dual-stack hosts give the same results on
+// every run; it defaults to "any".
+type GeoIPCfg struct {
+	Backend     string `json:"backend"`
+	MMDBPath    string `json:"mmdb_path"`
+	ASNMMDBPath string `json:"asn_mmdb_path"`
+	ReverseDNS  bool   `json:"reverse_dns"`
+	IPFamily    string `json:"ip_family"`
+}
+
+// HealthCfg configures the health server started by long running programs.
+// Addr is the address it listens on, and it isn't started if Addr is empty.
+// CheckServices adds the reachability of the GeoIP and TrackerMapper services
+// to its readiness check.
+type HealthCfg struct {
+	Addr          string `json:"addr"`
+	CheckServices bool   `json:"check_services"`
+}
+
+// TLSCfg configures TLS for the HTTP requests made to the GeoIP and
+// TrackerMapper services. CAFile is a PEM bundle of extra CAs to trust, and
+// CertFile and KeyFile a client certificate to present. InsecureSkipVerify
+// disables verifying server certificates and is only meant for development.
+type TLSCfg struct {
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
 // Config Struct for the Xray Config information relating to Dir and file
 // locations. As well as holding DB, Analyser and APIServ Config
 // information.
 type Config struct {
-	GeoIPEndpoint string        `json:"geoipurl"`
-	StorageConfig StorageConfig `json:"storage_config"`
-	SystemConfig  SystemConfig  `json:"system_config"`
-	Analyzer      AnalyzerCfg   `json:"analyzer"`
-	APIServ       APIServCfg    `json:"apiserv"`
-	DB            DBCfg         `json:"db"`
+	GeoIPEndpoint string   `json:"geoipurl"`
+	GeoIP         GeoIPCfg `json:"geoip"`
+
+	// GeoIPv6Endpoint is used instead of GeoIPEndpoint to look up IPv6
+	// addresses; the HTTP backend skips them if it isn't set. GeoIPSkipV6
+	// skips looking up IPv6 addresses entirely.
+	GeoIPv6Endpoint string `json:"geoipv6url"`
+	GeoIPSkipV6     bool   `json:"geoip_skip_v6"`
+
+	TrackerMapper TrackerMapperCfg `json:"tracker_mapper"`
+	StorageConfig StorageConfig    `json:"storage_config"`
+	SystemConfig  SystemConfig     `json:"system_config"`
+	Analyzer      AnalyzerCfg      `json:"analyzer"`
+	APIServ       APIServCfg       `json:"apiserv"`
+	DB            DBCfg            `json:"db"`
+
+	// The sections of the Node.js programs, and the vmname deep storage
+	// records APKs as being stored on.
+	Retriever  NodeCfg `json:"retriever"`
+	Explorer   NodeCfg `json:"explorer"`
+	Downloader NodeCfg `json:"downloader"`
+	Suggester  NodeCfg `json:"suggester"`
+	VMName     string  `json:"vmname"`
+
+	// UnpackTimeout is how long apktool may run for a single APK. It is
+	// parsed from RawUnpackTimeout, e.g. "5m".
+	UnpackTimeout    time.Duration `json:"-"`
+	RawUnpackTimeout string        `json:"unpack_timeout"`
+
+	// ApktoolPath is the apktool executable used to unpack APKs, and
+	// BundletoolPath the bundletool executable used to convert app bundles to
+	// APKs.
+	ApktoolPath    string `json:"apktool_path"`
+	BundletoolPath string `json:"bundletool_path"`
+
+	// FrameworkDir is the directory apktool installs frameworks in with
+	// InstallFramework and looks for them in when unpacking. apktool's default
+	// directory, in the home directory of the user running it, is used if it
+	// is empty.
+	FrameworkDir string `json:"framework_dir"`
+
+	// KnownSDKsPath is a JSON file mapping package prefixes to SDK names,
+	// like config/known_sdks.json, which the analyzer uses to report the SDKs
+	// apps embed. SDKs aren't detected if it is empty.
+	KnownSDKsPath string `json:"known_sdks_path"`
+
+	// SecretPatternsPath is a JSON file of patterns, in the format read by
+	// LoadSecretPatterns, that the analyzer scans apps for secrets with in
+	// addition to DefaultSecretPatterns.
+	SecretPatternsPath string `json:"secret_patterns_path"`
+
+	// ForceUnpack makes Unpack run apktool even if the app's OutDir already
+	// holds an up to date decode of its APK.
+	ForceUnpack bool `json:"force_unpack"`
+
+	// GeoIPCacheSize is the maximum number of IPs whose GeoIP info is kept
+	// in memory, and GeoIPCacheTTL how long an entry stays valid.
+	GeoIPCacheSize   int           `json:"geoip_cache_size"`
+	GeoIPCacheTTL    time.Duration `json:"-"`
+	RawGeoIPCacheTTL string        `json:"geoip_cache_ttl"`
+
+	// GeoIPConcurrency is the number of IPs of a host looked up at once.
+	// GeoIPMaxInFlight caps the number of requests made to the HTTP GeoIP
+	// service at once by the whole process, however many hosts are being
+	// looked up.
+	GeoIPConcurrency int `json:"geoip_concurrency"`
+	GeoIPMaxInFlight int `json:"geoip_max_in_flight"`
+
+	// DNSTimeout is how long resolving a host for GetHostGeoIP may take.
+	// DNSServer is the address of a DNS server, e.g. "8.8.8.8:53", to use
+	// instead of the system resolver.
+	DNSTimeout    time.Duration `json:"-"`
+	RawDNSTimeout string        `json:"dns_timeout"`
+	DNSServer     string        `json:"dns_server"`
+
+	// DNSCacheTTL is how long the addresses a host resolved to are cached.
+	// DNSMaxInFlight caps the number of DNS lookups made at once by the whole
+	// process.
+	DNSCacheTTL    time.Duration `json:"-"`
+	RawDNSCacheTTL string        `json:"dns_cache_ttl"`
+	DNSMaxInFlight int           `json:"dns_max_in_flight"`
+
+	// HTTPRetries is the number of times GetJSON retries a request that failed
+	// with a network error, 429 or 5xx; a negative number disables retrying.
+	// HTTPRetryDelay is the delay before the first retry, which doubles with
+	// each subsequent one.
+	HTTPRetries       int           `json:"http_retries"`
+	HTTPRetryDelay    time.Duration `json:"-"`
+	RawHTTPRetryDelay string        `json:"http_retry_delay"`
+
+	// HTTPTimeout is how long a single GetJSON request, including reading
+	// the body, may take. HTTPMaxIdleConns is the number of idle connections
+	// kept open to be reused by later requests, and HTTPIdleConnTimeout how
+	// long they are kept for.
+	HTTPTimeout            time.Duration `json:"-"`
+	RawHTTPTimeout         string        `json:"http_timeout"`
+	HTTPMaxIdleConns       int           `json:"http_max_idle_conns"`
+	HTTPIdleConnTimeout    time.Duration `json:"-"`
+	RawHTTPIdleConnTimeout string        `json:"http_idle_conn_timeout"`
+
+	// HTTPMaxBodySize is the largest response body, in bytes, GetJSON reads.
+	HTTPMaxBodySize int64 `json:"http_max_body_size"`
+
+	TLS TLSCfg `json:"tls"`
+
+	// LogLevel is the least severe level logged by Log: debug, info, notice,
+	// warn or error. LogJSON makes Log write JSON objects instead of plain
+	// text.
+	LogLevel string `json:"log_level"`
+	LogJSON  bool   `json:"log_json"`
+
+	Health HealthCfg `json:"health"`
+
+	// MetricsAddr is the address Prometheus metrics are served on by programs
+	// that support it. They aren't served if it is empty.
+	MetricsAddr string `json:"metrics_addr"`
+
+	// SockPath is the Unix domain socket `analyzer serve` answers analysis
+	// requests on.
+	SockPath string `json:"sockpath"`
 }
 
 // SystemConfig represents the config info related to the system the program
@@ -61,6 +265,9 @@ type StorageConfig struct {
 	APKDownloadDirectories []APKDownloadDirectory `json:"apk_download_directories"`
 	APKUnpackDirectory     string                 `json:"apk_unpack_directory"`
 	MinimumGBRequired      string                 `json:"minimum_gb_required"`
+	// Layout is how the directories apps are unpacked to are laid out in
+	// APKUnpackDirectory, LayoutLegacy or LayoutContent; see OutDir.
+	Layout string `json:"layout"`
 }
 
 // APKDownloadDirectory represents a possible location an APK could be stored on.
@@ -79,39 +286,420 @@ const (
 	APIServ
 )
 
-// LoadCfg Opens a config file and creates a series of objects
-// using the information located in the file. It constructs a
-// Config, populating information for the Analyser Config,
-// API Server Config and the DB config.
+// LoadCfg loads the config file cfgFile into Cfg, see Load.
 func LoadCfg(cfgFile string, requester int) error {
-	file, err := os.Open(cfgFile)
-	bytes, err := ioutil.ReadAll(file)
+	cfg, err := Load(cfgFile, requester)
+	if err != nil {
+		return err
+	}
+	Cfg = cfg
+
+	level, err := ParseLogLevel(Cfg.LogLevel)
 	if err != nil {
-		return errors.New("Couldn't read config file " + cfgFile)
+		return err
 	}
-	err = json.Unmarshal(bytes, &Cfg)
+	Log.SetLevel(level)
+	Log.SetJSON(Cfg.LogJSON)
+
+	client, err := NewHTTPClient(Cfg)
 	if err != nil {
-		return errors.New("Error reading JSON: " + err.Error())
+		return err
 	}
+	SetHTTPClient(client)
 
-	if Cfg.GeoIPEndpoint == "" {
-		Cfg.GeoIPEndpoint = "http://localhost/geoip"
+	fmt.Println("Config:")
+	fmt.Println("\tApp directories:", Cfg.StorageConfig.APKDownloadDirectories)
+	fmt.Println("\tUnpacked app directory:", Cfg.StorageConfig.APKUnpackDirectory)
+	if Cfg.TrackerMapper.Backend == TrackerMapperBackendFile {
+		fmt.Println("\tTrackerMapper rules file:", Cfg.TrackerMapper.Path)
+	} else {
+		fmt.Println("\tTrackerMapper URL:", Cfg.TrackerMapper.URL)
+	}
+
+	return nil
+}
+
+// legacyKeys are the top level keys of configs written for older versions,
+// which Load and LoadFrom ignore with a warning rather than rejecting like
+// other unknown keys, so existing deployments keep working.
+var legacyKeys = StrMap("edihost", "datadir", "unpackdir", "credDownload", "wordStashDir")
+
+// Load Opens a config file and creates a series of objects
+// using the information located in the file. It constructs a
+// Config, populating information for the Analyser Config,
+// API Server Config and the DB config. The DB credentials used are those of
+// requester.
+//
+// Values set in the environment (see applyEnv) take precedence over those in
+// the config file, which take precedence over the built-in defaults. Keys in
+// the config file that don't correspond to any option are an error, as are
+// incomplete database settings if requester has database credentials. The
+// keys older versions used, such as edihost and unpackdir, are ignored with a
+// warning instead.
+func Load(cfgFile string, requester int) (Config, error) {
+	f, err := os.Open(cfgFile)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			return Config{}, fmt.Errorf("config file %s doesn't exist: %w", cfgFile, err)
+		case os.IsPermission(err):
+			return Config{}, fmt.Errorf("no permission to read config file %s: %w", cfgFile, err)
+		}
+		return Config{}, fmt.Errorf("couldn't read config file %s: %w", cfgFile, err)
 	}
+	defer f.Close()
+	return loadFrom(f, "config file "+cfgFile, requester)
+}
+
+// LoadFrom is Load, reading the config from r instead of a file.
+func LoadFrom(r io.Reader, requester int) (Config, error) {
+	return loadFrom(r, "config", requester)
+}
 
-	Cfg.StorageConfig.APKUnpackDirectory = path.Clean(Cfg.StorageConfig.APKUnpackDirectory)
+// loadFrom implements Load and LoadFrom, describing where the config was read
+// from as source in errors.
+func loadFrom(r io.Reader, source string, requester int) (Config, error) {
+	var cfg Config
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return cfg, fmt.Errorf("couldn't read %s: %w", source, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&cfg); err != nil {
+		if !strings.HasPrefix(err.Error(), "json: unknown field ") {
+			return cfg, jsonError(source, err)
+		}
+		var unknown, legacy []string
+		for _, key := range unknownKeys(data, reflect.TypeOf(cfg), "") {
+			if _, ok := legacyKeys[key]; ok {
+				legacy = append(legacy, key)
+			} else {
+				unknown = append(unknown, key)
+			}
+		}
+		if len(unknown) > 0 {
+			return cfg, fmt.Errorf("unknown keys in %s: %s", source, strings.Join(unknown, ", "))
+		}
+		Log.Warning("Ignoring keys in %s that are no longer used: %s", source, strings.Join(legacy, ", "))
+		cfg = Config{}
+		if err = json.Unmarshal(data, &cfg); err != nil {
+			return cfg, jsonError(source, err)
+		}
+	}
 
 	switch requester {
 	case Analyzer:
-		Cfg.DB.User = Cfg.Analyzer.DB.User
-		Cfg.DB.Password = Cfg.Analyzer.DB.Password
+		cfg.DB.User = cfg.Analyzer.DB.User
+		cfg.DB.Password = cfg.Analyzer.DB.Password
 	case APIServ:
-		Cfg.DB.User = Cfg.APIServ.DB.User
-		Cfg.DB.Password = Cfg.APIServ.DB.Password
+		cfg.DB.User = cfg.APIServ.DB.User
+		cfg.DB.Password = cfg.APIServ.DB.Password
 	}
 
-	fmt.Println("Config:")
-	fmt.Println("\tApp directories:", Cfg.StorageConfig.APKDownloadDirectories)
-	fmt.Println("\tUnpacked app directory:", Cfg.StorageConfig.APKUnpackDirectory)
+	if err = applyEnv(&cfg); err != nil {
+		return cfg, err
+	}
+	if err = validateDB(cfg.DB); err != nil {
+		return cfg, err
+	}
+
+	if cfg.DB.BatchSize <= 0 {
+		cfg.DB.BatchSize = defaultDBBatchSize
+	}
+	cfg.DB.ConnectWait, err = parseDuration("db.connect_wait", cfg.DB.RawConnectWait, defaultDBConnectWait)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.GeoIPEndpoint == "" {
+		cfg.GeoIPEndpoint = "http://localhost/geoip"
+	}
+
+	switch cfg.GeoIP.Backend {
+	case "":
+		cfg.GeoIP.Backend = GeoIPBackendHTTP
+	case GeoIPBackendHTTP:
+	case GeoIPBackendMMDB:
+		if cfg.GeoIP.MMDBPath == "" {
+			return cfg, errors.New("geoip.mmdb_path must be set to use the mmdb GeoIP backend")
+		}
+	default:
+		return cfg, errors.New("Unknown GeoIP backend " + cfg.GeoIP.Backend)
+	}
+	switch cfg.StorageConfig.Layout {
+	case "":
+		cfg.StorageConfig.Layout = LayoutLegacy
+	case LayoutLegacy, LayoutContent:
+	default:
+		return cfg, errors.New("Unknown storage_config.layout " + cfg.StorageConfig.Layout + ", expected legacy or content")
+	}
+	switch cfg.GeoIP.IPFamily {
+	case "":
+		cfg.GeoIP.IPFamily = IPFamilyAny
+	case IPFamilyAny, IPFamilyV4, IPFamilyV6:
+	default:
+		return cfg, errors.New("Unknown geoip.ip_family " + cfg.GeoIP.IPFamily + ", expected any, v4 or v6")
+	}
+
+	if cfg.TrackerMapper.URL == "" {
+		cfg.TrackerMapper.URL = "http://localhost:8080/hosts"
+	}
+	switch cfg.TrackerMapper.Backend {
+	case "":
+		cfg.TrackerMapper.Backend = TrackerMapperBackendHTTP
+		fallthrough
+	case TrackerMapperBackendHTTP:
+		tmURL, err := url.Parse(cfg.TrackerMapper.URL)
+		if err != nil {
+			return cfg, errors.New("Invalid TrackerMapper URL " + cfg.TrackerMapper.URL + ": " + err.Error())
+		}
+		if tmURL.Scheme == "" || tmURL.Host == "" {
+			return cfg, errors.New("TrackerMapper URL " + cfg.TrackerMapper.URL + " must include a scheme and host")
+		}
+	case TrackerMapperBackendFile:
+		if cfg.TrackerMapper.Path == "" {
+			return cfg, errors.New("tracker_mapper.path must be set to use the file TrackerMapper backend")
+		}
+	default:
+		return cfg, errors.New("Unknown TrackerMapper backend " + cfg.TrackerMapper.Backend)
+	}
+	if cfg.TrackerMapper.Workers <= 0 {
+		cfg.TrackerMapper.Workers = 1
+	}
+	if cfg.TrackerMapper.RateLimit < 0 {
+		return cfg, errors.New("tracker_mapper.rate_limit can't be negative")
+	}
+
+	if cfg.ApktoolPath == "" {
+		cfg.ApktoolPath = "apktool"
+	}
+	if cfg.BundletoolPath == "" {
+		cfg.BundletoolPath = "bundletool"
+	}
+	if cfg.SockPath == "" {
+		cfg.SockPath = defaultSockPath
+	}
+
+	cfg.UnpackTimeout, err = parseDuration("unpack_timeout", cfg.RawUnpackTimeout, 5*time.Minute)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.GeoIPCacheSize <= 0 {
+		cfg.GeoIPCacheSize = defaultGeoIPCacheSize
+	}
+	if cfg.GeoIPConcurrency <= 0 {
+		cfg.GeoIPConcurrency = defaultGeoIPConcurrency
+	}
+	if cfg.GeoIPMaxInFlight <= 0 {
+		cfg.GeoIPMaxInFlight = defaultGeoIPMaxInFlight
+	}
+	cfg.GeoIPCacheTTL, err = parseDuration("geoip_cache_ttl", cfg.RawGeoIPCacheTTL, defaultGeoIPCacheTTL)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.DNSTimeout, err = parseDuration("dns_timeout", cfg.RawDNSTimeout, defaultDNSTimeout)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(cfg.DNSServer); err != nil {
+			cfg.DNSServer = net.JoinHostPort(cfg.DNSServer, "53")
+		}
+	}
+	cfg.DNSCacheTTL, err = parseDuration("dns_cache_ttl", cfg.RawDNSCacheTTL, defaultDNSCacheTTL)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.DNSMaxInFlight <= 0 {
+		cfg.DNSMaxInFlight = defaultDNSMaxInFlight
+	}
+
+	if cfg.HTTPRetries == 0 {
+		cfg.HTTPRetries = defaultHTTPRetries
+	}
+	cfg.HTTPRetryDelay, err = parseDuration("http_retry_delay", cfg.RawHTTPRetryDelay, defaultHTTPRetryDelay)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.HTTPTimeout, err = parseDuration("http_timeout", cfg.RawHTTPTimeout, defaultHTTPTimeout)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPMaxIdleConns <= 0 {
+		cfg.HTTPMaxIdleConns = defaultHTTPMaxIdleConns
+	}
+	cfg.HTTPIdleConnTimeout, err = parseDuration("http_idle_conn_timeout", cfg.RawHTTPIdleConnTimeout,
+		defaultHTTPIdleConnTimeout)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.HTTPMaxBodySize <= 0 {
+		cfg.HTTPMaxBodySize = defaultHTTPMaxBodySize
+	}
+
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+	}
+	if _, err = ParseLogLevel(cfg.LogLevel); err != nil {
+		return cfg, err
+	}
+
+	cfg.StorageConfig.APKUnpackDirectory = path.Clean(cfg.StorageConfig.APKUnpackDirectory)
+
+	return cfg, nil
+}
+
+// jsonError describes an error decoding the config read from source, such as
+// "config file config.json", including where in it the error occurred.
+func jsonError(source string, err error) error {
+	switch jsonErr := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Errorf("syntax error in %s at offset %d: %w", source, jsonErr.Offset, err)
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("bad value for %s in %s at offset %d: %w",
+			jsonErr.Field, source, jsonErr.Offset, err)
+	}
+	return fmt.Errorf("error reading JSON from %s: %w", source, err)
+}
+
+// unknownKeys returns the keys in the JSON data that don't correspond to a
+// field of t, as dotted paths from the root of data. Fields are matched the
+// same way as by encoding/json, ignoring case.
+func unknownKeys(data []byte, t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var keys []string
+	switch t.Kind() {
+	case reflect.Struct:
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(data, &obj) != nil {
+			return nil
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			field, ok := jsonField(t, name)
+			if !ok {
+				keys = append(keys, prefix+name)
+				continue
+			}
+			keys = append(keys, unknownKeys(obj[name], field.Type, prefix+name+".")...)
+		}
+	case reflect.Slice, reflect.Array:
+		var elems []json.RawMessage
+		if json.Unmarshal(data, &elems) != nil {
+			return nil
+		}
+		base := strings.TrimSuffix(prefix, ".")
+		for i, elem := range elems {
+			keys = append(keys, unknownKeys(elem, t.Elem(), fmt.Sprintf("%s[%d].", base, i))...)
+		}
+	}
+	return keys
+}
+
+// jsonField returns the field of the struct type t that the JSON key name is
+// decoded into.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if tag == "" {
+			tag = field.Name
+		}
+		if strings.EqualFold(tag, name) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// validateDB checks the database settings in db. Programs can run without a
+// database, so they are only required to be set if there is a user to
+// connect as.
+func validateDB(db DBCfg) error {
+	if db.Port < 0 || db.Port > 65535 {
+		return fmt.Errorf("db.port must be between 1 and 65535, not %d", db.Port)
+	}
+	if db.User == "" {
+		return nil
+	}
+
+	var missing []string
+	if db.Database == "" {
+		missing = append(missing, "db.database")
+	}
+	if db.Host == "" {
+		missing = append(missing, "db.host")
+	}
+	if db.Port == 0 {
+		missing = append(missing, "db.port")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s must be set to connect to the database as %s", strings.Join(missing, ", "), db.User)
+	}
+	return nil
+}
+
+// parseDuration parses the duration config option name, returning def if raw
+// is empty.
+func parseDuration(name, raw string, def time.Duration) (time.Duration, error) {
+	if raw == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, errors.New("Invalid " + name + " " + raw + ": " + err.Error())
+	}
+	return d, nil
+}
+
+// applyEnv overrides values in cfg with those set in the environment:
+//
+//	XRAY_DB_DATABASE, XRAY_DB_HOST, XRAY_DB_PORT, XRAY_DB_USER,
+//	XRAY_DB_PASSWORD      the database connection settings
+//	XRAY_UNPACK_DIR       storage_config.apk_unpack_directory
+//	XRAY_GEOIP_URL        geoipurl
+//	XRAY_TRACKER_MAPPER_URL
+//	                      tracker_mapper.url
+func applyEnv(cfg *Config) error {
+	envStr := func(name string, dst *string) {
+		if val, ok := os.LookupEnv(name); ok {
+			*dst = val
+		}
+	}
+
+	envStr("XRAY_DB_DATABASE", &cfg.DB.Database)
+	envStr("XRAY_DB_HOST", &cfg.DB.Host)
+	envStr("XRAY_DB_USER", &cfg.DB.User)
+	envStr("XRAY_DB_PASSWORD", &cfg.DB.Password)
+	envStr("XRAY_UNPACK_DIR", &cfg.StorageConfig.APKUnpackDirectory)
+	envStr("XRAY_GEOIP_URL", &cfg.GeoIPEndpoint)
+	envStr("XRAY_TRACKER_MAPPER_URL", &cfg.TrackerMapper.URL)
+
+	if val, ok := os.LookupEnv("XRAY_DB_PORT"); ok {
+		port, err := strconv.Atoi(val)
+		if err != nil {
+			return errors.New("Invalid XRAY_DB_PORT " + val + ": " + err.Error())
+		}
+		cfg.DB.Port = port
+	}
 
 	return nil
 }
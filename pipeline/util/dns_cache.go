@@ -0,0 +1,132 @@
+package util
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Defaults for the DNS cache and the number of DNS lookups made at once, used
+// when the config doesn't specify them.
+const (
+	defaultDNSCacheTTL    = 5 * time.Minute
+	defaultDNSMaxInFlight = 16
+)
+
+// dnsCacheSize is the maximum number of hosts whose addresses are cached.
+const dnsCacheSize = 10000
+
+// dnsCache is an LRU cache of the addresses hosts resolved to. Entries expire
+// after Cfg.DNSCacheTTL, and failed lookups aren't cached.
+type dnsCache struct {
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+type dnsCacheEntry struct {
+	host    string
+	addrs   []string
+	expires time.Time
+}
+
+var hostCache = newDNSCache()
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached addresses of host, if there is an entry that hasn't
+// expired.
+func (c *dnsCache) get(host string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[host]
+	if !ok {
+		dnsCacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	entry := elem.Value.(*dnsCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.ll.Remove(elem)
+		delete(c.entries, host)
+		dnsCacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	dnsCacheLookups.WithLabelValues("hit").Inc()
+	return append([]string{}, entry.addrs...), true
+}
+
+// add caches the addresses of host, evicting the least recently used entries
+// if the cache is full.
+func (c *dnsCache) add(host string, addrs []string) {
+	ttl := Cfg.DNSCacheTTL
+	if ttl <= 0 {
+		ttl = defaultDNSCacheTTL
+	}
+	addrs = append([]string{}, addrs...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[host]; ok {
+		entry := elem.Value.(*dnsCacheEntry)
+		entry.addrs, entry.expires = addrs, time.Now().Add(ttl)
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	c.entries[host] = c.ll.PushFront(&dnsCacheEntry{host, addrs, time.Now().Add(ttl)})
+	for c.ll.Len() > dnsCacheSize {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).host)
+	}
+}
+
+func (c *dnsCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// ClearDNSCache removes all entries from the DNS cache used by ResolveHost.
+func ClearDNSCache() {
+	hostCache.clear()
+}
+
+// dnsLookups limits the number of DNS lookups in flight across the process to
+// Cfg.DNSMaxInFlight. It is created on first use.
+var (
+	dnsLookupsOnce sync.Once
+	dnsLookups     *semaphore.Weighted
+)
+
+// acquireDNSLookup waits for one of the Cfg.DNSMaxInFlight lookup slots, which
+// must be released with releaseDNSLookup.
+func acquireDNSLookup() {
+	dnsLookupsOnce.Do(func() {
+		n := Cfg.DNSMaxInFlight
+		if n <= 0 {
+			n = defaultDNSMaxInFlight
+		}
+		dnsLookups = semaphore.NewWeighted(int64(n))
+	})
+	// Acquire only fails if the context is done, which Background never is.
+	dnsLookups.Acquire(context.Background(), 1)
+}
+
+// releaseDNSLookup releases a slot acquired with acquireDNSLookup.
+func releaseDNSLookup() {
+	dnsLookups.Release(1)
+}
@@ -0,0 +1,212 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// urlRe matches http and https URLs, capturing their scheme and host.
+var urlRe = regexp.MustCompile(`(?i)\b(https?)://([a-z0-9](?:[a-z0-9.-]*[a-z0-9])?|\[[0-9a-f:.]+\])`)
+
+// domainRe matches domain names quoted in smali or XML, capturing the domain
+// without any leading "*." wildcard. The character after the domain must be
+// checked to be a closing quote or the start of a tag, since the regexp can't
+// look ahead.
+var domainRe = regexp.MustCompile(`(?i)["'>](?:\*\.)?((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,63})`)
+
+// formatSpec matches a format specifier: a printf style verb such as %s, %1$s
+// or %02d, or a {0}, {name} or ${name} placeholder.
+const formatSpec = `(?:%(?:\d+\$)?[-#+ 0]*\d*(?:\.\d+)?[a-z@]|\$?\{[\w.]*\})`
+
+// templateRe matches the rest of a line after a host that is continued by a
+// format specifier, either joined to the host by a dot or hyphen or followed
+// by more of the host.
+var templateRe = regexp.MustCompile(`(?i)^(?:[.-]` + formatSpec + `|` + formatSpec + `[a-z0-9.-])`)
+
+// packagePrefixes are first labels of package and class names, which look
+// like domain names but aren't used as hosts.
+var packagePrefixes = StrMap("com", "org", "net", "io", "android", "androidx", "java", "javax",
+	"kotlin", "dalvik")
+
+// fileExts are file extensions that are also top level domains.
+var fileExts = StrMap("so", "py", "md", "sh", "zip", "mov", "pl", "rs", "mk")
+
+// binarySniffLen is the number of bytes at the start of a file checked for NUL
+// bytes, which mark it as binary.
+const binarySniffLen = 8000
+
+// ExtractHosts scans the smali output and the res and assets directories of
+// the unpacked app, and of its Splits, for the hosts of http and https URLs
+// and for quoted domain names. It returns the domain names, normalized with
+// NormalizeHost and without duplicates, in the order they're found. The hosts
+// of http URLs are also recorded in app.CleartextHosts; see CheckCleartext.
+// It must be called after Unpack. If app.ResourcesUndecoded is set, hosts only
+// referenced by the undecoded resources.arsc aren't found, and likewise hosts
+// only referenced by code unless it was disassembled to smali.
+//
+// Files are read a line at a time, and binary files, such as images and
+// compiled resources, are skipped. Hosts are classified as follows:
+//
+//   - Ports and the brackets around IPv6 addresses are stripped, so
+//     "http://[2001:db8::1]:8080/" yields 2001:db8::1.
+//   - IP addresses are recorded in app.HostIPs rather than returned, as they
+//     don't need resolving before being looked up with GeoIP.
+//   - Hosts continued by a format specifier, such as "http://cdn.%s.com" or
+//     "https://api-{region}.example.com", are dropped, as the host they were
+//     templated from is unknown. A specifier directly after the host that
+//     isn't followed by more of it, as in "http://example.com%s", is taken to
+//     be the path, so example.com is kept.
+//   - Quoted strings only count as domain names if their top level domain is
+//     in the public suffix list and they don't look like package or file
+//     names. A leading "*." wildcard, as in certificate pins, is stripped.
+func (app *App) ExtractHosts() ([]string, error) {
+	dirs := []string{app.OutDir()}
+	for _, split := range app.Splits {
+		dirs = append(dirs, app.SplitDir(split))
+	}
+
+	if app.ResourcesUndecoded {
+		Log.Debug("Resources of %s weren't decoded, only scanning its code and assets", app.ID)
+	}
+
+	var hosts, ips, cleartext []string
+	for _, dir := range dirs {
+		roots, err := smaliDirs(dir)
+		if err == ErrNoSmali {
+			Log.Debug("Code in %s wasn't disassembled, so hosts only referenced by it, cleartext or not, aren't found", dir)
+		} else if err != nil {
+			return nil, err
+		}
+		roots = append(roots, path.Join(dir, "res"), path.Join(dir, "assets"))
+
+		for _, root := range roots {
+			if _, err := os.Stat(root); os.IsNotExist(err) {
+				continue
+			}
+			err = filepath.Walk(root, func(fname string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.Mode().IsRegular() {
+					return nil
+				}
+				found, foundCleartext, err := scanHosts(fname)
+				if err != nil {
+					return err
+				}
+				for _, host := range found {
+					if net.ParseIP(host) != nil {
+						ips = append(ips, host)
+					} else {
+						hosts = append(hosts, host)
+					}
+				}
+				cleartext = append(cleartext, foundCleartext...)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	app.HostIPs = Dedup(ips)
+	app.CleartextHosts = Dedup(cleartext)
+	return Dedup(hosts), nil
+}
+
+// scanHosts returns the hosts found in the file fname, along with those of
+// them found in http URLs, or nothing if it is binary.
+func scanHosts(fname string) (hosts, cleartext []string, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, binarySniffLen)
+	head, err := r.Peek(binarySniffLen)
+	if err != nil && len(head) == 0 {
+		return nil, nil, nil
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil, nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxSmaliLine)
+	for scanner.Scan() {
+		lh, lc := lineHosts(scanner.Bytes())
+		hosts = append(hosts, lh...)
+		cleartext = append(cleartext, lc...)
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			Log.Debug("Skipping the rest of %s: line too long", fname)
+			return hosts, cleartext, nil
+		}
+		return nil, nil, fmt.Errorf("couldn't scan %s: %s", fname, err.Error())
+	}
+	return hosts, cleartext, nil
+}
+
+// lineHosts returns the hosts of the URLs and the quoted domain names in line,
+// along with the hosts of the http URLs.
+func lineHosts(line []byte) (hosts, cleartext []string) {
+	for _, m := range urlRe.FindAllSubmatchIndex(line, -1) {
+		if templateRe.Match(line[m[1]:]) {
+			continue
+		}
+		host := NormalizeHost(string(line[m[4]:m[5]]))
+		if !isHost(host) {
+			continue
+		}
+		hosts = append(hosts, host)
+		if strings.EqualFold(string(line[m[2]:m[3]]), "http") {
+			cleartext = append(cleartext, host)
+		}
+	}
+	for _, m := range domainRe.FindAllSubmatchIndex(line, -1) {
+		if m[1] < len(line) && !strings.ContainsRune(`"'<`, rune(line[m[1]])) {
+			continue
+		}
+		if host := NormalizeHost(string(line[m[2]:m[3]])); isDomain(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, cleartext
+}
+
+// isHost reports whether host, the normalized host of a URL, is an IP address
+// or a domain name with a top level domain in the public suffix list.
+func isHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if !strings.Contains(host, ".") {
+		return false
+	}
+	_, icann := publicsuffix.PublicSuffix(host)
+	return icann
+}
+
+// isDomain reports whether host, a normalized quoted string, is likely to be
+// a domain name rather than a package, class or file name.
+func isDomain(host string) bool {
+	labels := strings.Split(host, ".")
+	if _, ok := packagePrefixes[labels[0]]; ok {
+		return false
+	}
+	if _, ok := fileExts[labels[len(labels)-1]]; ok {
+		return false
+	}
+	return isHost(host)
+}
@@ -0,0 +1,612 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultGeoIPConcurrency is used when the config doesn't specify
+// geoip_concurrency.
+const defaultGeoIPConcurrency = 8
+
+// defaultGeoIPMaxInFlight is used when the config doesn't specify
+// geoip_max_in_flight.
+const defaultGeoIPMaxInFlight = 32
+
+// defaultDNSTimeout is used when the config doesn't specify dns_timeout.
+const defaultDNSTimeout = 5 * time.Second
+
+// Address families selectable with the geoip.ip_family config option.
+const (
+	IPFamilyAny = "any"
+	IPFamilyV4  = "v4"
+	IPFamilyV6  = "v6"
+)
+
+// GeoIPInfo stores apphosts data for geolocation
+type GeoIPInfo struct {
+	IP          string  `json:"ip"`
+	CountryCode string  `json:"country_code"`
+	CountryName string  `json:"country_name"`
+	RegionCode  string  `json:"region_code"`
+	RegionName  string  `json:"region_name"`
+	City        string  `json:"city"`
+	ZipCode     string  `json:"zip_code"`
+	TimeZone    string  `json:"time_zone"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	MetroCode   int     `json:"metro_code"`
+
+	// ASN and ASNOrg are the number and organization of the autonomous
+	// system IP belongs to, if the backend knows them, and zero otherwise.
+	ASN    int    `json:"asn,omitempty"`
+	ASNOrg string `json:"asn_org,omitempty"`
+
+	// PTR holds the reverse DNS names of IP, if Cfg.GeoIP.ReverseDNS is set.
+	PTR []string `json:"ptr,omitempty"`
+}
+
+// UnmarshalJSON decodes GeoIP info as served by HTTP GeoIP services. Services
+// write the ASN either as a number or as a string like "AS15169"; anything
+// else leaves ASN zero rather than failing.
+func (inf *GeoIPInfo) UnmarshalJSON(data []byte) error {
+	type plain GeoIPInfo
+	aux := struct {
+		*plain
+		ASN json.RawMessage `json:"asn"`
+	}{plain: (*plain)(inf)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	inf.ASN = 0
+	var asn string
+	if err := json.Unmarshal(aux.ASN, &asn); err != nil {
+		asn = string(aux.ASN)
+	}
+	asn = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(asn)), "AS")
+	if n, err := strconv.Atoi(asn); err == nil && n > 0 {
+		inf.ASN = n
+	}
+	return nil
+}
+
+// GeoIPLookupError records the failure to look up the GeoIP info of one IP.
+type GeoIPLookupError struct {
+	IP  string
+	Err error
+}
+
+func (e GeoIPLookupError) Error() string {
+	return fmt.Sprintf("couldn't lookup geoip info for %s: %s", e.IP, e.Err.Error())
+}
+
+// DNSTimeoutError is returned by GetHostGeoIP and ResolveHost when resolving Host took longer
+// than Cfg.DNSTimeout, as opposed to the host not existing.
+type DNSTimeoutError struct {
+	Host string
+	Err  error
+}
+
+func (e DNSTimeoutError) Error() string {
+	return fmt.Sprintf("timed out resolving %s: %s", e.Host, e.Err.Error())
+}
+
+func (e DNSTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports that the error is a timeout, for net.Error.
+func (e DNSTimeoutError) Timeout() bool {
+	return true
+}
+
+// GeoIPErrors is returned by GetHostGeoIP when the lookups of some of a host's
+// IPs failed. It is ordered by IP.
+type GeoIPErrors []GeoIPLookupError
+
+func (e GeoIPErrors) Error() string {
+	strs := make([]string, 0, len(e))
+	for _, err := range e {
+		strs = append(strs, err.Error())
+	}
+	return strings.Join(strs, "; ")
+}
+
+// Errors returns the individual lookup errors.
+func (e GeoIPErrors) Errors() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// ipLess orders IPs by their 16 byte representation, falling back to string
+// comparison for anything that doesn't parse.
+func ipLess(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a < b
+	}
+	if c := bytes.Compare(ipA.To16(), ipB.To16()); c != 0 {
+		return c < 0
+	}
+	// Order different spellings of the same IP, e.g. ::ffff:192.0.2.1.
+	return a < b
+}
+
+// ipFamilyName returns the name of family, one of the IPFamily constants, for
+// use in messages.
+func ipFamilyName(family string) string {
+	switch family {
+	case IPFamilyV4:
+		return "IPv4"
+	case IPFamilyV6:
+		return "IPv6"
+	}
+	return "IP"
+}
+
+// filterIPFamily returns the IPs of ips in family, one of the IPFamily
+// constants. IPv4-mapped IPv6 addresses are IPv4 addresses.
+func filterIPFamily(ips []string, family string) []string {
+	if family == "" || family == IPFamilyAny {
+		return ips
+	}
+	filtered := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed != nil && (parsed.To4() != nil) == (family == IPFamilyV4) {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+// isIPv6 reports whether ip is an IPv6 address other than an IPv4-mapped one.
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// IPResolution is the outcome of looking up the GeoIP info of one of a host's
+// IPs: either Info, or the reason the lookup failed in Err. Skipped is set
+// instead if the IP is an IPv6 address and Cfg.GeoIPSkipV6 is set, or the HTTP
+// backend is used without a Cfg.GeoIPv6Endpoint.
+type IPResolution struct {
+	IP      string
+	Info    GeoIPInfo
+	Err     error
+	Skipped bool
+}
+
+// HostResolution records what happened when looking up the GeoIP info of a
+// host: the IPs it resolved to, in order, along with the outcome for each.
+// Err is set if the host couldn't be resolved at all, or the GeoIP backend
+// couldn't be opened, in which case there are no IPs.
+type HostResolution struct {
+	Host string
+	IPs  []IPResolution
+	Err  error
+}
+
+// Infos returns the GeoIP info of the IPs that were looked up successfully.
+func (r HostResolution) Infos() []GeoIPInfo {
+	infos := make([]GeoIPInfo, 0, len(r.IPs))
+	for _, ip := range r.IPs {
+		if ip.Err == nil && !ip.Skipped {
+			infos = append(infos, ip.Info)
+		}
+	}
+	return infos
+}
+
+// Errors returns the failed lookups, or nil if there weren't any.
+func (r HostResolution) Errors() GeoIPErrors {
+	var errs GeoIPErrors
+	for _, ip := range r.IPs {
+		if ip.Err != nil {
+			errs = append(errs, GeoIPLookupError{ip.IP, ip.Err})
+		}
+	}
+	return errs
+}
+
+// ResolveHost resolves host and looks up the GeoIP info of each of its IPs,
+// using the backend selected by Cfg.GeoIP.Backend. geoipHost is the endpoint
+// used by the HTTP backend; IPv6 addresses are looked up using
+// Cfg.GeoIPv6Endpoint instead, and aren't looked up at all if it isn't set or
+// Cfg.GeoIPSkipV6 is set.
+//
+// Unless host is an IP address, it is resolved using the resolver set with
+// SetResolver, or else Cfg.DNSServer, or the system resolver if it isn't set.
+// Err is a DNSTimeoutError if that takes longer than Cfg.DNSTimeout. Only the
+// addresses in Cfg.GeoIP.IPFamily are looked up, and it is an error for host
+// to have none.
+//
+// If Cfg.GeoIP.ReverseDNS is set, the PTR records of each IP are looked up as
+// well; IPs without any are left with an empty PTR.
+//
+// Up to Cfg.GeoIPConcurrency IPs are looked up at once, and the IPs of the
+// result are ordered by IP.
+func ResolveHost(geoipHost, host string) HostResolution {
+	res := HostResolution{Host: host}
+	backend, err := geoIPBackend(geoipHost)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		ips, err = lookupHost(host)
+		if err != nil {
+			res.Err = err
+			return res
+		}
+	}
+	if ips = filterIPFamily(ips, Cfg.GeoIP.IPFamily); len(ips) == 0 {
+		res.Err = fmt.Errorf("%s has no %s addresses", host, ipFamilyName(Cfg.GeoIP.IPFamily))
+		return res
+	}
+	sort.Slice(ips, func(i, j int) bool { return ipLess(ips[i], ips[j]) })
+
+	res.IPs = make([]IPResolution, len(ips))
+	var lookups []int
+	for i, ip := range ips {
+		res.IPs[i].IP = ip
+		if isIPv6(ip) && Cfg.GeoIPSkipV6 {
+			Log.Warning("Skipping geoip lookup of IPv6 address %s", ip)
+			res.IPs[i].Skipped = true
+			continue
+		}
+		if _, ok := backend.(HTTPGeoIPLookup); ok && isIPv6(ip) && Cfg.GeoIPv6Endpoint == "" {
+			Log.Warning("Skipping geoip lookup of IPv6 address %s, as geoipv6url isn't set", ip)
+			res.IPs[i].Skipped = true
+			continue
+		}
+		lookups = append(lookups, i)
+	}
+
+	workers := Cfg.GeoIPConcurrency
+	if workers <= 0 {
+		workers = defaultGeoIPConcurrency
+	}
+	if workers > len(lookups) {
+		workers = len(lookups)
+	}
+
+	// Each worker only writes to the elements of res.IPs it is sent.
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r := &res.IPs[i]
+				inf, ok := geoCache.get(r.IP)
+				if !ok {
+					var err error
+					inf, err = backend.Lookup(r.IP)
+					if err != nil {
+						r.Err = err
+						Log.Warning("%s", GeoIPLookupError{r.IP, err}.Error())
+						continue
+					}
+					if Cfg.GeoIP.ReverseDNS {
+						inf.PTR = lookupPTR(r.IP)
+					}
+					geoCache.add(r.IP, inf)
+				}
+				r.Info = inf
+			}
+		}()
+	}
+	for _, i := range lookups {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return res
+}
+
+// GetHostGeoIP grabs geo location information from hostname, as described by
+// ResolveHost, returning the GeoIP info of the IPs that were looked up
+// successfully. If some lookups fail, the successful results are returned
+// along with a GeoIPErrors, so a GeoIPErrors with no results means every
+// lookup failed. Requests to the HTTP backend are made with the client set
+// with SetHTTPClient.
+func GetHostGeoIP(geoipHost, host string) ([]GeoIPInfo, error) {
+	res := ResolveHost(geoipHost, host)
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	if errs := res.Errors(); len(errs) > 0 {
+		return res.Infos(), errs
+	}
+	return res.Infos(), nil
+}
+
+// unknownCountry is the country code AggregateGeo counts entries without a
+// country code under.
+const unknownCountry = "??"
+
+// AggregateGeo counts the entries of infos in each country, keyed by country
+// code. Entries with an empty or unknown ("XX") country code are counted
+// under "??".
+func AggregateGeo(infos []GeoIPInfo) map[string]int {
+	countries := make(map[string]int)
+	for _, inf := range infos {
+		cc := strings.ToUpper(strings.TrimSpace(inf.CountryCode))
+		if cc == "" || cc == "XX" || cc == unknownCountry {
+			cc = unknownCountry
+		}
+		countries[cc]++
+	}
+	return countries
+}
+
+// DedupGeoIP returns infos without duplicate entries for the same IP, such as
+// those of CDN IPs shared by several hosts of an app, in the order each IP
+// first appears. Of the entries for an IP, the one with the most fields set is
+// kept, or the first of them if several have as many.
+func DedupGeoIP(infos []GeoIPInfo) []GeoIPInfo {
+	ret := make([]GeoIPInfo, 0, len(infos))
+	seen := make(map[string]int, len(infos))
+	for _, inf := range infos {
+		i, ok := seen[inf.IP]
+		if !ok {
+			seen[inf.IP] = len(ret)
+			ret = append(ret, inf)
+		} else if geoIPFields(inf) > geoIPFields(ret[i]) {
+			ret[i] = inf
+		}
+	}
+	return ret
+}
+
+// geoIPFields returns the number of fields of inf that are set.
+func geoIPFields(inf GeoIPInfo) int {
+	n := 0
+	for _, set := range []bool{
+		inf.CountryCode != "", inf.CountryName != "", inf.RegionCode != "", inf.RegionName != "",
+		inf.City != "", inf.ZipCode != "", inf.TimeZone != "", inf.Latitude != 0 || inf.Longitude != 0,
+		inf.MetroCode != 0, inf.ASN != 0, inf.ASNOrg != "", len(inf.PTR) > 0,
+	} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// HostLookupError records the failure to look up the GeoIP info of some or all
+// of the IPs of a host.
+type HostLookupError struct {
+	Host string
+	Err  error
+}
+
+func (e HostLookupError) Error() string {
+	return fmt.Sprintf("couldn't look up the location of %s: %s", e.Host, e.Err.Error())
+}
+
+func (e HostLookupError) Unwrap() error {
+	return e.Err
+}
+
+// HostLookupErrors is returned by GeoIPAll when some of an app's hosts
+// couldn't be looked up. It is ordered by host.
+type HostLookupErrors []HostLookupError
+
+func (e HostLookupErrors) Error() string {
+	strs := make([]string, 0, len(e))
+	for _, err := range e {
+		strs = append(strs, err.Error())
+	}
+	return strings.Join(strs, "; ")
+}
+
+// Errors returns the individual host errors.
+func (e HostLookupErrors) Errors() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// GeoIPAll looks up the GeoIP info of each of the app's Hosts and HostIPs with
+// GetHostGeoIP, up to concurrency hosts at once, or Cfg.GeoIPConcurrency if it
+// is 0 or less. It returns the infos of each host with at least one IP that
+// was looked up successfully, so hosts that couldn't be looked up at all are
+// missing. Their failures, as well as those of hosts only some of whose IPs
+// failed, are returned together as a HostLookupErrors.
+func (app *App) GeoIPAll(geoipHost string, concurrency int) (map[string][]GeoIPInfo, error) {
+	hosts := UniqAppend(app.Hosts, app.HostIPs)
+	if concurrency <= 0 {
+		concurrency = Cfg.GeoIPConcurrency
+	}
+	if concurrency <= 0 {
+		concurrency = defaultGeoIPConcurrency
+	}
+	if concurrency > len(hosts) {
+		concurrency = len(hosts)
+	}
+
+	ret := make(map[string][]GeoIPInfo, len(hosts))
+	var errs HostLookupErrors
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range jobs {
+				infos, err := GetHostGeoIP(geoipHost, host)
+				mu.Lock()
+				if len(infos) > 0 {
+					ret[host] = infos
+				}
+				if err != nil {
+					errs = append(errs, HostLookupError{host, err})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, host := range hosts {
+		jobs <- host
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Host < errs[j].Host })
+		return ret, errs
+	}
+	return ret, nil
+}
+
+// GeoCountries looks up the GeoIP info of each of the app's Hosts and HostIPs
+// with GeoIPAll and returns the number of hosts with an IP in each country, as
+// AggregateGeo keys them. A host with IPs in several countries counts towards
+// each of them. Hosts that can't be looked up are skipped; an error is
+// returned along with the counts of the others if there were any.
+func (app *App) GeoCountries(geoipHost string) (map[string]int, error) {
+	all, err := app.GeoIPAll(geoipHost, 0)
+	var errs HostLookupErrors
+	if errors.As(err, &errs) {
+		for _, hostErr := range errs {
+			if _, ok := all[hostErr.Host]; !ok {
+				Log.Warning("%s", hostErr.Error())
+			}
+		}
+	}
+
+	countries := make(map[string]int)
+	for _, infos := range all {
+		for cc := range AggregateGeo(infos) {
+			countries[cc]++
+		}
+	}
+
+	hosts := len(UniqAppend(app.Hosts, app.HostIPs))
+	if failed := hosts - len(all); failed > 0 {
+		return countries, fmt.Errorf("couldn't look up %d of %d hosts of %s", failed, hosts, app.ID)
+	}
+	return countries, nil
+}
+
+// Resolver looks up the addresses of hosts and the names of addresses, as
+// *net.Resolver does.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// resolver is the Resolver set with SetResolver, if any.
+var (
+	resolverMu sync.RWMutex
+	resolver   Resolver
+)
+
+// SetResolver sets the resolver used by ResolveHost and GetHostGeoIP to look
+// up hosts, e.g. to a fake one in tests. A nil resolver restores the default,
+// which uses Cfg.DNSServer or the system resolver.
+func SetResolver(r Resolver) {
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	resolver = r
+}
+
+// dnsResolver returns the resolver to use for looking up hosts: the one set
+// with SetResolver, otherwise the system's, unless Cfg.DNSServer is set.
+func dnsResolver() Resolver {
+	resolverMu.RLock()
+	r := resolver
+	resolverMu.RUnlock()
+	if r != nil {
+		return r
+	}
+
+	server := Cfg.DNSServer
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// dnsContext returns a context that expires after Cfg.DNSTimeout.
+func dnsContext() (context.Context, context.CancelFunc) {
+	timeout := Cfg.DNSTimeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// lookupHost looks up the addresses of host, returning a DNSTimeoutError if
+// that takes too long. Addresses are cached for Cfg.DNSCacheTTL, and at most
+// Cfg.DNSMaxInFlight lookups are made at once; the timeout only starts once
+// the lookup does.
+func lookupHost(host string) ([]string, error) {
+	if addrs, ok := hostCache.get(host); ok {
+		return addrs, nil
+	}
+
+	acquireDNSLookup()
+	defer releaseDNSLookup()
+	ctx, cancel := dnsContext()
+	defer cancel()
+
+	addrs, err := dnsResolver().LookupHost(ctx, host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if ctx.Err() == context.DeadlineExceeded || (errors.As(err, &dnsErr) && dnsErr.IsTimeout) {
+			return nil, DNSTimeoutError{host, err}
+		}
+		return nil, err
+	}
+	hostCache.add(host, addrs)
+	return addrs, nil
+}
+
+// lookupPTR returns the reverse DNS names of ip without their trailing dots.
+// Failures, most commonly NXDOMAIN, are only logged, since many IPs have no
+// PTR records.
+func lookupPTR(ip string) []string {
+	acquireDNSLookup()
+	defer releaseDNSLookup()
+	ctx, cancel := dnsContext()
+	defer cancel()
+
+	names, err := dnsResolver().LookupAddr(ctx, ip)
+	if err != nil {
+		Log.Debug("No PTR records for %s: %s", ip, err.Error())
+		return nil
+	}
+	for i, name := range names {
+		names[i] = strings.TrimSuffix(name, ".")
+	}
+	return names
+}
@@ -0,0 +1,151 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// GeoIP backends selectable with the geoip.backend config option.
+const (
+	GeoIPBackendHTTP = "http"
+	GeoIPBackendMMDB = "mmdb"
+)
+
+// GeoIPLookup looks up the GeoIP info of a single IP.
+type GeoIPLookup interface {
+	Lookup(ip string) (GeoIPInfo, error)
+}
+
+// ErrNoV6Endpoint is returned by HTTPGeoIPLookup.Lookup for IPv6 addresses
+// when it has no V6Endpoint to look them up at.
+var ErrNoV6Endpoint = errors.New("no GeoIP endpoint for IPv6 addresses")
+
+// HTTPGeoIPLookup looks up IPs using a freegeoip style HTTP service, which
+// serves the info of an IP at <endpoint>/<ip>. IPv6 addresses are looked up at
+// V6Endpoint instead, and can't be looked up if it isn't set.
+type HTTPGeoIPLookup struct {
+	Endpoint   string
+	V6Endpoint string
+}
+
+// Lookup implements GeoIPLookup.
+func (h HTTPGeoIPLookup) Lookup(ip string) (GeoIPInfo, error) {
+	endpoint := h.Endpoint
+	if isIPv6(ip) {
+		if h.V6Endpoint == "" {
+			return GeoIPInfo{}, fmt.Errorf("%w: can't look up %s", ErrNoV6Endpoint, ip)
+		}
+		endpoint = h.V6Endpoint
+	}
+
+	var inf GeoIPInfo
+	err := getGeoIPJSON(endpoint+"/"+url.PathEscape(ip), &inf)
+	return inf, err
+}
+
+// MMDBGeoIPLookup looks up IPs in a local MaxMind GeoLite2/GeoIP2 City
+// database, and optionally their ASNs in an ASN database.
+type MMDBGeoIPLookup struct {
+	db  *geoip2.Reader
+	asn *geoip2.Reader
+}
+
+// OpenMMDBGeoIPLookup opens the MaxMind database at dbPath.
+func OpenMMDBGeoIPLookup(dbPath string) (*MMDBGeoIPLookup, error) {
+	db, err := geoip2.Open(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open GeoIP database %s: %s", dbPath, err.Error())
+	}
+	return &MMDBGeoIPLookup{db: db}, nil
+}
+
+// OpenASN opens the MaxMind ASN database at dbPath, which is then used to
+// fill in the ASN and ASNOrg of looked up IPs.
+func (m *MMDBGeoIPLookup) OpenASN(dbPath string) error {
+	asn, err := geoip2.Open(dbPath)
+	if err != nil {
+		return fmt.Errorf("couldn't open ASN database %s: %s", dbPath, err.Error())
+	}
+	m.asn = asn
+	return nil
+}
+
+// Lookup implements GeoIPLookup.
+func (m *MMDBGeoIPLookup) Lookup(ip string) (GeoIPInfo, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return GeoIPInfo{}, fmt.Errorf("%s isn't an IP address", ip)
+	}
+
+	rec, err := m.db.City(parsed)
+	if err != nil {
+		return GeoIPInfo{}, err
+	}
+
+	inf := GeoIPInfo{
+		IP:          ip,
+		CountryCode: rec.Country.IsoCode,
+		CountryName: rec.Country.Names["en"],
+		City:        rec.City.Names["en"],
+		ZipCode:     rec.Postal.Code,
+		TimeZone:    rec.Location.TimeZone,
+		Latitude:    rec.Location.Latitude,
+		Longitude:   rec.Location.Longitude,
+		MetroCode:   int(rec.Location.MetroCode),
+	}
+	if len(rec.Subdivisions) > 0 {
+		inf.RegionCode = rec.Subdivisions[0].IsoCode
+		inf.RegionName = rec.Subdivisions[0].Names["en"]
+	}
+
+	// Missing ASN data isn't worth failing the lookup over.
+	if m.asn != nil {
+		asn, err := m.asn.ASN(parsed)
+		if err != nil {
+			Log.Debug("Couldn't look up the ASN of %s: %s", ip, err.Error())
+		} else {
+			inf.ASN = int(asn.AutonomousSystemNumber)
+			inf.ASNOrg = asn.AutonomousSystemOrganization
+		}
+	}
+	return inf, nil
+}
+
+// Close closes the underlying databases.
+func (m *MMDBGeoIPLookup) Close() error {
+	if m.asn != nil {
+		m.asn.Close()
+	}
+	return m.db.Close()
+}
+
+var (
+	mmdbOnce   sync.Once
+	mmdbLookup *MMDBGeoIPLookup
+	mmdbErr    error
+)
+
+// geoIPBackend returns the GeoIP backend selected in the config. geoipHost is
+// the endpoint used by the HTTP backend. The MaxMind database is only opened
+// once and shared between calls.
+func geoIPBackend(geoipHost string) (GeoIPLookup, error) {
+	if Cfg.GeoIP.Backend != GeoIPBackendMMDB {
+		return HTTPGeoIPLookup{Endpoint: geoipHost, V6Endpoint: Cfg.GeoIPv6Endpoint}, nil
+	}
+
+	mmdbOnce.Do(func() {
+		mmdbLookup, mmdbErr = OpenMMDBGeoIPLookup(Cfg.GeoIP.MMDBPath)
+		if mmdbErr == nil && Cfg.GeoIP.ASNMMDBPath != "" {
+			mmdbErr = mmdbLookup.OpenASN(Cfg.GeoIP.ASNMMDBPath)
+		}
+	})
+	if mmdbErr != nil {
+		return nil, mmdbErr
+	}
+	return mmdbLookup, nil
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Defaults for the GeoIP cache, used when the config doesn't specify them.
+const (
+	defaultGeoIPCacheSize = 10000
+	defaultGeoIPCacheTTL  = 24 * time.Hour
+)
+
+// geoIPCache is an LRU cache of GeoIP info keyed by IP. Entries expire after
+// Cfg.GeoIPCacheTTL and are then refetched.
+type geoIPCache struct {
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+type geoIPCacheEntry struct {
+	ip      string
+	info    GeoIPInfo
+	expires time.Time
+}
+
+var geoCache = newGeoIPCache()
+
+func newGeoIPCache() *geoIPCache {
+	return &geoIPCache{
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached info for ip, if there is an entry that hasn't
+// expired.
+func (c *geoIPCache) get(ip string) (GeoIPInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[ip]
+	if !ok {
+		return GeoIPInfo{}, false
+	}
+	entry := elem.Value.(*geoIPCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.ll.Remove(elem)
+		delete(c.entries, ip)
+		return GeoIPInfo{}, false
+	}
+	c.ll.MoveToFront(elem)
+	return entry.info, true
+}
+
+// add caches info for ip, evicting the least recently used entries if the
+// cache is full.
+func (c *geoIPCache) add(ip string, info GeoIPInfo) {
+	maxEntries, ttl := Cfg.GeoIPCacheSize, Cfg.GeoIPCacheTTL
+	if maxEntries <= 0 {
+		maxEntries = defaultGeoIPCacheSize
+	}
+	if ttl <= 0 {
+		ttl = defaultGeoIPCacheTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[ip]; ok {
+		entry := elem.Value.(*geoIPCacheEntry)
+		entry.info, entry.expires = info, time.Now().Add(ttl)
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	c.entries[ip] = c.ll.PushFront(&geoIPCacheEntry{ip, info, time.Now().Add(ttl)})
+	for c.ll.Len() > maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*geoIPCacheEntry).ip)
+	}
+}
+
+func (c *geoIPCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// ClearGeoIPCache removes all entries from the GeoIP cache used by
+// GetHostGeoIP.
+func ClearGeoIPCache() {
+	geoCache.clear()
+}
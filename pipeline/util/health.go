@@ -0,0 +1,94 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readinessChecks are run by the /readyz endpoint of the health server, by
+// name.
+var (
+	readinessMu     sync.Mutex
+	readinessChecks = map[string]func() error{}
+)
+
+// AddReadinessCheck registers a check run by the health server's /readyz
+// endpoint. The process is only reported as ready if every check returns nil.
+func AddReadinessCheck(name string, check func() error) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	readinessChecks[name] = check
+}
+
+// CheckReachable returns a readiness check that fails if a GET of url fails
+// or returns a 5xx. It is meant for services like GeoIP and TrackerMapper,
+// where any response means the service is up.
+func CheckReachable(url string) func() error {
+	return func() error {
+		client := http.Client{Timeout: 5 * time.Second, Transport: getHTTPClient().Transport}
+		r, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		r.Body.Close()
+		if r.StatusCode >= 500 {
+			return fmt.Errorf("got status %d from %s", r.StatusCode, url)
+		}
+		return nil
+	}
+}
+
+// healthHandler serves /healthz, which always succeeds while the process is
+// up, and /readyz, which succeeds if all the readiness checks pass.
+func healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		readinessMu.Lock()
+		names := make([]string, 0, len(readinessChecks))
+		checks := make(map[string]func() error, len(readinessChecks))
+		for name, check := range readinessChecks {
+			names = append(names, name)
+			checks[name] = check
+		}
+		readinessMu.Unlock()
+		sort.Strings(names)
+
+		var failed []string
+		for _, name := range names {
+			if err := checks[name](); err != nil {
+				failed = append(failed, name+": "+err.Error())
+			}
+		}
+		if len(failed) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(strings.Join(failed, "\n") + "\n"))
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// StartHealthServer serves the /healthz and /readyz endpoints on addr in the
+// background. It only returns an error if it can't listen on addr.
+func StartHealthServer(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("couldn't start health server: %s", err.Error())
+	}
+	go func() {
+		if err := http.Serve(l, healthHandler()); err != nil {
+			Log.Err("Health server stopped: %s", err.Error())
+		}
+	}()
+	Log.Info("Serving health checks on %s", l.Addr())
+	return nil
+}
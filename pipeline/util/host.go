@@ -0,0 +1,33 @@
+package util
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// NormalizeHost lowercases host and strips any port, trailing dots and leading
+// "www.", so that e.g. "www.Facebook.com.:443" becomes "facebook.com". IP
+// addresses are stripped of brackets and written in their canonical form, so
+// "[2001:DB8:0::1]:80" becomes "2001:db8::1".
+func NormalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(strings.TrimSuffix(host, "]"), "[")
+	host = strings.TrimRight(host, ".")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return strings.TrimPrefix(host, "www.")
+}
+
+// RegisteredDomain returns the registered domain (eTLD+1) of host according to
+// the public suffix list, e.g. "facebook.com" for both analytics.facebook.com
+// and graph.facebook.com, or "example.co.uk" for cdn.example.co.uk. host is
+// normalized with NormalizeHost first.
+func RegisteredDomain(host string) (string, error) {
+	return publicsuffix.EffectiveTLDPlusOne(NormalizeHost(host))
+}
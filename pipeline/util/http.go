@@ -0,0 +1,343 @@
+package util
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Defaults for retrying failed requests in GetJSON and for its HTTP client,
+// used when the config doesn't specify them.
+const (
+	defaultHTTPRetries         = 3
+	defaultHTTPRetryDelay      = 500 * time.Millisecond
+	defaultHTTPTimeout         = 10 * time.Second
+	defaultHTTPMaxIdleConns    = 100
+	defaultHTTPIdleConnTimeout = 90 * time.Second
+	defaultHTTPMaxBodySize     = 1 << 20
+)
+
+// httpClient is shared by all requests made by GetJSON so connections are
+// reused.
+var (
+	httpClientMu sync.RWMutex
+	httpClient   = &http.Client{Timeout: defaultHTTPTimeout}
+)
+
+// NewHTTPClient returns the client GetJSON should use according to cfg: it
+// times out after cfg.HTTPTimeout, keeps up to cfg.HTTPMaxIdleConns idle
+// connections for cfg.HTTPIdleConnTimeout, and uses the TLS settings in
+// cfg.TLS. As GetJSON makes most of its requests to only a couple of hosts,
+// all of the idle connections may be to the same host.
+func NewHTTPClient(cfg Config) (*http.Client, error) {
+	transport, err := NewTLSTransport(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	transport.MaxIdleConns = cfg.HTTPMaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.HTTPMaxIdleConns
+	transport.IdleConnTimeout = cfg.HTTPIdleConnTimeout
+
+	return &http.Client{Timeout: cfg.HTTPTimeout, Transport: transport}, nil
+}
+
+// SetHTTPClient sets the client used by GetJSON.
+func SetHTTPClient(client *http.Client) {
+	httpClientMu.Lock()
+	defer httpClientMu.Unlock()
+	httpClient = client
+}
+
+// SetHTTPTransport sets the transport used by GetJSON. A nil transport means
+// http.DefaultTransport.
+func SetHTTPTransport(transport *http.Transport) {
+	httpClientMu.Lock()
+	defer httpClientMu.Unlock()
+
+	client := *httpClient
+	if transport == nil {
+		client.Transport = nil
+	} else {
+		client.Transport = transport
+	}
+	httpClient = &client
+}
+
+func getHTTPClient() *http.Client {
+	httpClientMu.RLock()
+	defer httpClientMu.RUnlock()
+	return httpClient
+}
+
+// HTTPClient returns the client used by GetJSON, so that other requests to the
+// GeoIP and TrackerMapper services use the same TLS settings.
+func HTTPClient() *http.Client {
+	return getHTTPClient()
+}
+
+// NewTLSTransport returns a transport that verifies servers using the CA
+// bundle cfg.CAFile (in addition to the system roots) and presents the client
+// certificate cfg.CertFile/cfg.KeyFile, if they are set. It returns nil if
+// cfg doesn't configure anything, so the default transport is used.
+func NewTLSTransport(cfg TLSCfg) (*http.Transport, error) {
+	if cfg == (TLSCfg{}) {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read CA bundle %s: %s", cfg.CAFile, err.Error())
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("both tls.cert_file and tls.key_file must be set to use a client certificate")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load client certificate: %s", err.Error())
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	return transport, nil
+}
+
+// maxErrBodyLen is the number of bytes of a failed response's body kept in an
+// HTTPStatusError.
+const maxErrBodyLen = 512
+
+// HTTPStatusError is returned by GetJSON and GetJSONStream when the server
+// responds with a status other than 200 OK. Body holds the start of the
+// response body, unless it was compressed.
+type HTTPStatusError struct {
+	URL  string
+	Code int
+	Body string
+}
+
+func (e *HTTPStatusError) Error() string {
+	msg := fmt.Sprintf("got status %d from %s", e.Code, e.URL)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// ErrBodyTooLarge is returned (wrapped) by GetJSON when a response body is
+// larger than Cfg.HTTPMaxBodySize.
+var ErrBodyTooLarge = errors.New("response body too large")
+
+// GetJSON from valid url string gets json. Requests that fail because of a
+// network error or a 429 or 5xx status are retried up to Cfg.HTTPRetries times
+// with exponential backoff. A response with a status other than 200 results in
+// an *HTTPStatusError, and one whose body, once decompressed, is larger than
+// Cfg.HTTPMaxBodySize in an error wrapping ErrBodyTooLarge. Each attempt,
+// including reading the body, must finish within Cfg.HTTPTimeout.
+func GetJSON(url string, target interface{}) error {
+	return getWithRetries(url, nil, maxBodySize(), func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(target)
+	})
+}
+
+// geoIPRequests limits the number of GeoIP requests in flight across the
+// process to Cfg.GeoIPMaxInFlight. It is created on first use.
+var (
+	geoIPRequestsOnce sync.Once
+	geoIPRequests     *semaphore.Weighted
+)
+
+// getGeoIPJSON is GetJSON for requests to the GeoIP service, which waits for
+// one of the Cfg.GeoIPMaxInFlight request slots shared by the whole process
+// before each attempt.
+func getGeoIPJSON(url string, target interface{}) error {
+	geoIPRequestsOnce.Do(func() {
+		n := Cfg.GeoIPMaxInFlight
+		if n <= 0 {
+			n = defaultGeoIPMaxInFlight
+		}
+		geoIPRequests = semaphore.NewWeighted(int64(n))
+	})
+	return getWithRetries(url, geoIPRequests, maxBodySize(), func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(target)
+	})
+}
+
+// GetJSONStream gets a JSON array from url and calls fn with each of its
+// elements in turn, without reading the whole array into memory. It retries
+// in the same way as GetJSON, but never once fn has been called. An error
+// returned by fn stops the decoding and is returned as is. As the array isn't
+// held in memory, its size isn't limited.
+func GetJSONStream(url string, fn func(json.RawMessage) error) error {
+	return getWithRetries(url, nil, 0, func(body io.Reader) error {
+		return decodeJSONArray(body, fn)
+	})
+}
+
+// decodeJSONArray reads a JSON array from r, calling fn with each element.
+func decodeJSONArray(r io.Reader, fn func(json.RawMessage) error) error {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected a JSON array, got %v", tok)
+	}
+
+	for dec.More() {
+		var elem json.RawMessage
+		if err := dec.Decode(&elem); err != nil {
+			return err
+		}
+		if err := fn(elem); err != nil {
+			return err
+		}
+	}
+
+	// Consume the closing bracket so truncated arrays are reported.
+	_, err = dec.Token()
+	return err
+}
+
+// maxBodySize returns the largest response body GetJSON reads.
+func maxBodySize() int64 {
+	if Cfg.HTTPMaxBodySize <= 0 {
+		return defaultHTTPMaxBodySize
+	}
+	return Cfg.HTTPMaxBodySize
+}
+
+// getWithRetries gets url, retrying failed requests, and passes the body of
+// the successful response to decode. If sem isn't nil, a slot of it is held
+// during each attempt, but not while waiting to retry. If limit isn't 0,
+// bodies larger than limit bytes aren't read past it.
+func getWithRetries(url string, sem *semaphore.Weighted, limit int64, decode func(io.Reader) error) error {
+	for attempt := 0; ; attempt++ {
+		if sem != nil {
+			if err := sem.Acquire(context.Background(), 1); err != nil {
+				return err
+			}
+		}
+		retry, err := get(url, limit, decode)
+		if sem != nil {
+			sem.Release(1)
+		}
+		if err == nil || !retry || attempt >= Cfg.HTTPRetries {
+			return err
+		}
+
+		delay := retryDelay(attempt)
+		Log.Debug("Retrying GET %s in %s: %s", url, delay, err.Error())
+		time.Sleep(delay)
+	}
+}
+
+// get makes a single attempt at getting url and decoding its body. It reports
+// whether the request should be retried if it fails; failures to decode the
+// body are never retried. Responses are requested gzip compressed, and
+// successful ones are decompressed before decoding if the server obliges. The attempt is given
+// Cfg.HTTPTimeout to finish whatever client GetJSON is using, so that a server
+// sending its body slowly can't hang decode.
+func get(url string, limit int64, decode func(io.Reader) error) (bool, error) {
+	timeout := Cfg.HTTPTimeout
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	r, err := getHTTPClient().Do(req)
+	if err != nil {
+		countHTTPRequest(0)
+		return true, err
+	}
+	defer r.Body.Close()
+	countHTTPRequest(r.StatusCode)
+
+	if r.StatusCode != http.StatusOK {
+		retry := r.StatusCode == http.StatusTooManyRequests || r.StatusCode >= 500
+		return retry, &HTTPStatusError{URL: url, Code: r.StatusCode, Body: errBody(r)}
+	}
+
+	var body io.Reader = r.Body
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return false, fmt.Errorf("invalid gzip response from %s: %s", url, err.Error())
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	if limit == 0 {
+		return false, decode(body)
+	}
+	// Allow one byte more than the limit to tell bodies exactly limit bytes
+	// long from larger ones.
+	limited := &io.LimitedReader{R: body, N: limit + 1}
+	err = decode(limited)
+	if limited.N == 0 {
+		return false, fmt.Errorf("%w: %s sent more than %d bytes", ErrBodyTooLarge, url, limit)
+	}
+	return false, err
+}
+
+// errBody returns the start of the body of the failed response r, for an
+// HTTPStatusError. Only bodies that are decoded are decompressed, so that of a
+// gzipped response is left out.
+func errBody(r *http.Response) string {
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return ""
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(r.Body, maxErrBodyLen))
+	return string(data)
+}
+
+// retryDelay returns how long to wait before retry number attempt+1: the base
+// delay doubled for each previous retry, with up to half of it as jitter.
+func retryDelay(attempt int) time.Duration {
+	delay := Cfg.HTTPRetryDelay
+	if delay <= 0 {
+		delay = defaultHTTPRetryDelay
+	}
+	delay <<= uint(attempt)
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
@@ -0,0 +1,198 @@
+package util
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrNoIcon is returned (wrapped) by ExtractIcon when the app has no launcher
+// icon it can copy.
+var ErrNoIcon = errors.New("no launcher icon found")
+
+// maxIconDepth is the number of adaptive icon layers ExtractIcon follows.
+const maxIconDepth = 2
+
+// rasterExts are the image formats ExtractIcon copies.
+var rasterExts = StrMap(".png", ".webp", ".jpg")
+
+// densities are the dpi of the density qualifiers of resource directories.
+// Resources in directories without one are mdpi.
+var densities = map[string]int{
+	"ldpi": 120, "mdpi": 160, "tvdpi": 213, "hdpi": 240, "xhdpi": 320, "xxhdpi": 480, "xxxhdpi": 640,
+	"nodpi": 0, "anydpi": 1 << 16,
+}
+
+// manifestIcon holds the launcher icon of an AndroidManifest.xml.
+type manifestIcon struct {
+	Application struct {
+		Icon string `xml:"icon,attr"`
+	} `xml:"application"`
+}
+
+// adaptiveIcon is an adaptive-icon drawable.
+type adaptiveIcon struct {
+	XMLName    xml.Name `xml:"adaptive-icon"`
+	Foreground struct {
+		Drawable string `xml:"drawable,attr"`
+	} `xml:"foreground"`
+}
+
+// resourceFile is a file defining a resource, along with the density of the
+// directory it is in.
+type resourceFile struct {
+	path    string
+	density int
+}
+
+// resourceDensity returns the density of the resource directory dir, e.g. 480
+// for mipmap-xxhdpi-v4.
+func resourceDensity(dir string) int {
+	for _, qualifier := range strings.Split(dir, "-")[1:] {
+		if density, ok := densities[qualifier]; ok {
+			return density
+		}
+	}
+	return densities["mdpi"]
+}
+
+// resourceFiles returns the files in resDir defining the resource of any of
+// the given types with the given name, highest density first.
+func resourceFiles(resDir string, types map[string]Unit, name string) ([]resourceFile, error) {
+	dirs, err := ioutil.ReadDir(resDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var files []resourceFile
+	for _, dir := range dirs {
+		if _, ok := types[strings.SplitN(dir.Name(), "-", 2)[0]]; !ok || !dir.IsDir() {
+			continue
+		}
+		matches, err := filepath.Glob(path.Join(resDir, dir.Name(), name+".*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			// Exclude e.g. name.9.png, which is another resource.
+			if strings.TrimSuffix(path.Base(match), path.Ext(match)) == name {
+				files = append(files, resourceFile{match, resourceDensity(dir.Name())})
+			}
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].density > files[j].density })
+	return files, nil
+}
+
+// resolveIcon returns the highest density raster image of the drawable or
+// mipmap ref, such as "@mipmap/ic_launcher", in resDir. Both drawables and
+// mipmaps of the same name are considered, since apps often only provide
+// raster versions of adaptive or vector icons as one or the other. If there
+// are none, the foreground layer of an adaptive icon is resolved instead.
+func resolveIcon(resDir, ref string, depth int) (string, error) {
+	split := strings.SplitN(strings.TrimPrefix(ref, "@"), "/", 2)
+	if !strings.HasPrefix(ref, "@") || len(split) != 2 || strings.Contains(split[0], ":") {
+		return "", fmt.Errorf("%w: can't resolve %q", ErrNoIcon, ref)
+	}
+	typ, name := split[0], split[1]
+	types := StrMap(typ)
+	if typ == "mipmap" || typ == "drawable" {
+		types = StrMap("mipmap", "drawable")
+	}
+
+	files, err := resourceFiles(resDir, types, name)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if _, ok := rasterExts[strings.ToLower(path.Ext(f.path))]; ok {
+			return f.path, nil
+		}
+	}
+
+	if depth < maxIconDepth {
+		for _, f := range files {
+			if path.Ext(f.path) != ".xml" {
+				continue
+			}
+			data, err := ioutil.ReadFile(f.path)
+			if err != nil {
+				return "", err
+			}
+			var icon adaptiveIcon
+			if xml.Unmarshal(data, &icon) != nil || icon.Foreground.Drawable == "" {
+				continue
+			}
+			if fg, err := resolveIcon(resDir, icon.Foreground.Drawable, depth+1); err == nil {
+				return fg, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: %s has no raster image", ErrNoIcon, ref)
+}
+
+// ExtractIcon copies the launcher icon referenced by the android:icon
+// attribute of the app's manifest to the directory of the APK, as icon.png,
+// icon.webp or icon.jpg, and sets app.Icon to the path it was copied to. The
+// icon is kept there rather than in AppDir whatever the layout, as that is
+// where the icon URLs stored in the DB are served from. The highest
+// density raster image of the icon is copied. Adaptive and vector icons are
+// replaced by a raster version of the same name if there is one, and adaptive
+// icons otherwise by their foreground layer. It must be called after Unpack,
+// and fails with ErrNoIcon if the app has no icon, or only vector images of
+// it.
+func (app *App) ExtractIcon() (string, error) {
+	if app.ResourcesUndecoded {
+		return "", fmt.Errorf("%w: resources weren't decoded", ErrNoIcon)
+	}
+	data, err := app.readManifest()
+	if err != nil {
+		return "", err
+	}
+	var manifest manifestIcon
+	if err = xml.Unmarshal(data, &manifest); err != nil {
+		return "", fmt.Errorf("couldn't parse manifest: %s", err.Error())
+	}
+	if manifest.Application.Icon == "" {
+		return "", fmt.Errorf("%w: the manifest doesn't set one", ErrNoIcon)
+	}
+
+	src, err := resolveIcon(path.Join(app.OutDir(), "res"), manifest.Application.Icon, 0)
+	if err != nil {
+		return "", err
+	}
+	dst := path.Join(app.legacyAppDir(), "icon"+strings.ToLower(path.Ext(src)))
+	if err := copyFile(src, dst); err != nil {
+		return "", fmt.Errorf("couldn't copy icon %s: %s", src, err.Error())
+	}
+	app.Icon = dst
+	return dst, nil
+}
+
+// copyFile copies the file src to dst, replacing it if it exists.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
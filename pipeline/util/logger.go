@@ -2,7 +2,10 @@ package util
 
 import (
 	"fmt"
+	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 //Logger For Systemd logs
@@ -20,6 +23,27 @@ const (
 	DEBUG
 )
 
+// Names of the debug levels, used in JSON output and the log_level config
+// option.
+var levelNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// ParseLogLevel parses the name of a debug level. "error" and "warn" are
+// accepted as aliases of "err" and "warning".
+func ParseLogLevel(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "error":
+		return ERR, nil
+	case "warn":
+		return WARNING, nil
+	}
+	for level, levelName := range levelNames {
+		if strings.ToLower(name) == levelName {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s", name)
+}
+
 // func log(level DebugLevel, args ...string) {
 // 	fmt.Println(prefixes[level], args)
 // }
@@ -29,10 +53,48 @@ type logger struct{}
 // Log is the namespace for the logger functions
 var Log = logger{}
 
+var (
+	logMu    sync.Mutex
+	logLevel = INFO
+	logJSON  bool
+)
+
+// SetLevel sets the least severe level that is logged.
+func (l logger) SetLevel(level int) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logLevel = level
+}
+
+// SetJSON switches between logging a JSON object per message and the
+// systemd prefixed plain text format.
+func (l logger) SetJSON(enable bool) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logJSON = enable
+}
+
+type jsonLogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"msg"`
+}
+
 func (l logger) Log(level int, str string, args ...interface{}) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	if level > logLevel {
+		return
+	}
+
+	msg := fmt.Sprintf(str, args...)
+	if logJSON {
+		WriteJSON(os.Stdout, jsonLogEntry{time.Now(), levelNames[level], msg})
+		return
+	}
 	fmt.Println(prefixes[level] +
-		strings.Replace(fmt.Sprintf(str, args...),
-			"\n", "\n"+prefixes[level], -1))
+		strings.Replace(msg, "\n", "\n"+prefixes[level], -1))
 }
 
 func (l logger) Emerg(str string, args ...interface{}) {
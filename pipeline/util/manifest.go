@@ -0,0 +1,178 @@
+package util
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+)
+
+// axmlMagic is the header of a binary (undecoded) AndroidManifest.xml.
+var axmlMagic = []byte{0x03, 0x00, 0x08, 0x00}
+
+// ErrBinaryManifest is returned when the AndroidManifest.xml in an app's
+// OutDir is still in Android's binary XML format, i.e. apktool didn't decode
+// it.
+var ErrBinaryManifest = errors.New("AndroidManifest.xml is binary XML")
+
+// manifestPerms holds the permission elements of an AndroidManifest.xml.
+type manifestPerms struct {
+	Perms      []Permission `xml:"uses-permission"`
+	Sdk23Perms []Permission `xml:"uses-permission-sdk-23"`
+}
+
+// readManifest reads the decoded AndroidManifest.xml from an app's OutDir.
+func (app *App) readManifest() ([]byte, error) {
+	return readManifestIn(app.OutDir())
+}
+
+// readManifestIn reads the decoded AndroidManifest.xml in dir.
+func readManifestIn(dir string) ([]byte, error) {
+	manifestPath := path.Join(dir, "AndroidManifest.xml")
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no manifest found at %s", manifestPath)
+		}
+		return nil, err
+	}
+	if bytes.HasPrefix(data, axmlMagic) {
+		return nil, ErrBinaryManifest
+	}
+	return data, nil
+}
+
+// ParsePermissions reads the permissions requested in the app's
+// AndroidManifest.xml and sets app.Perms. It must be called after Unpack.
+// Permissions requested more than once are only included once.
+//
+// The manifests of the app's Splits are read too, and the permissions only
+// they request are added to app.Perms and recorded in app.SplitPerms by split
+// name.
+func (app *App) ParsePermissions() error {
+	data, err := app.readManifest()
+	if err != nil {
+		return err
+	}
+	all, err := manifestPermissions(data)
+	if err != nil {
+		return err
+	}
+
+	perms := make([]Permission, 0, len(all))
+	seen := make(map[string]Unit, len(all))
+	for _, perm := range all {
+		if _, ok := seen[perm.ID]; !ok {
+			seen[perm.ID] = unit
+			perms = append(perms, perm)
+		}
+	}
+
+	app.SplitPerms = nil
+	for _, split := range app.Splits {
+		data, err := readManifestIn(app.SplitDir(split))
+		if err != nil {
+			return fmt.Errorf("split %s: %s", SplitName(split), err.Error())
+		}
+		splitPerms, err := manifestPermissions(data)
+		if err != nil {
+			return fmt.Errorf("split %s: %s", SplitName(split), err.Error())
+		}
+
+		for _, perm := range splitPerms {
+			if _, ok := seen[perm.ID]; !ok {
+				seen[perm.ID] = unit
+				perms = append(perms, perm)
+				if app.SplitPerms == nil {
+					app.SplitPerms = make(map[string][]Permission)
+				}
+				app.SplitPerms[SplitName(split)] = append(app.SplitPerms[SplitName(split)], perm)
+			}
+		}
+	}
+
+	app.Perms = perms
+	return nil
+}
+
+// manifestPermissions returns the permissions requested in the decoded
+// manifest data, in the order they appear.
+func manifestPermissions(data []byte) ([]Permission, error) {
+	var manifest manifestPerms
+	if err := xml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("couldn't parse manifest: %s", err.Error())
+	}
+	return append(manifest.Perms, manifest.Sdk23Perms...), nil
+}
+
+// manifestVersion holds the version information of an AndroidManifest.xml.
+type manifestVersion struct {
+	Package     string `xml:"package,attr"`
+	VersionCode string `xml:"versionCode,attr"`
+	UsesSdk     struct {
+		MinSdk    string `xml:"minSdkVersion,attr"`
+		TargetSdk string `xml:"targetSdkVersion,attr"`
+	} `xml:"uses-sdk"`
+}
+
+// apktoolYmlRe matches the version information apktool moves from the manifest
+// into apktool.yml.
+var apktoolYmlRe = regexp.MustCompile(`(?m)^\s*(versionCode|minSdkVersion|targetSdkVersion):\s*'?(\d+)'?\s*$`)
+
+// ManifestInfo returns the package name, version code and minimum and target
+// SDK versions of the unpacked app. It must be called after Unpack.
+//
+// apktool moves the version code and SDK versions from the manifest into
+// apktool.yml, so they are read from there when the manifest doesn't have
+// them. As on Android, the minimum SDK defaults to 1 and the target SDK to the
+// minimum SDK.
+func (app *App) ManifestInfo() (pkg string, versionCode int, minSdk int, targetSdk int, err error) {
+	data, err := app.readManifest()
+	if err != nil {
+		return "", 0, 0, 0, err
+	}
+
+	var manifest manifestVersion
+	if err = xml.Unmarshal(data, &manifest); err != nil {
+		return "", 0, 0, 0, fmt.Errorf("couldn't parse manifest: %s", err.Error())
+	}
+
+	values := map[string]string{
+		"versionCode":      manifest.VersionCode,
+		"minSdkVersion":    manifest.UsesSdk.MinSdk,
+		"targetSdkVersion": manifest.UsesSdk.TargetSdk,
+	}
+	if yml, err := ioutil.ReadFile(path.Join(app.OutDir(), "apktool.yml")); err == nil {
+		for _, m := range apktoolYmlRe.FindAllSubmatch(yml, -1) {
+			if values[string(m[1])] == "" {
+				values[string(m[1])] = string(m[2])
+			}
+		}
+	}
+
+	parsed := make(map[string]int, len(values))
+	for name, val := range values {
+		if val == "" {
+			continue
+		}
+		if parsed[name], err = strconv.Atoi(val); err != nil {
+			return "", 0, 0, 0, fmt.Errorf("invalid %s %s in manifest", name, val)
+		}
+	}
+
+	minSdk = parsed["minSdkVersion"]
+	if minSdk == 0 {
+		minSdk = 1
+	}
+	targetSdk = parsed["targetSdkVersion"]
+	if targetSdk == 0 {
+		targetSdk = minSdk
+	}
+
+	return manifest.Package, parsed["versionCode"], minSdk, targetSdk, nil
+}
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// httpRequests counts the requests made by GetJSON and GetJSONStream, by
+// response status, or "error" if no response was received.
+var httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "xray",
+	Name:      "http_requests_total",
+	Help:      "HTTP requests made by GetJSON, by response status.",
+}, []string{"code"})
+
+// dnsCacheLookups counts the lookups of the DNS cache used by ResolveHost, by
+// whether they were a "hit" or a "miss".
+var dnsCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "xray",
+	Name:      "dns_cache_lookups_total",
+	Help:      "Lookups of the DNS cache, by whether the host was cached.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(httpRequests, dnsCacheLookups)
+}
+
+// countHTTPRequest records a request made by GetJSON with the given response
+// status, or 0 if it failed without a response.
+func countHTTPRequest(code int) {
+	label := "error"
+	if code != 0 {
+		label = strconv.Itoa(code)
+	}
+	httpRequests.WithLabelValues(label).Inc()
+}
+
+// StartMetricsServer serves the Prometheus metrics registered by the pipeline
+// on addr at /metrics, in the background. It only returns an error if it
+// can't listen on addr.
+func StartMetricsServer(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("couldn't start metrics server: %s", err.Error())
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			Log.Err("Metrics server stopped: %s", err.Error())
+		}
+	}()
+	Log.Info("Serving metrics on %s", l.Addr())
+	return nil
+}
@@ -0,0 +1,54 @@
+package util
+
+import "strings"
+
+// ObfuscationScore considers identifiers at most shortIdentLen long
+// obfuscated, and an average length of readableIdentLen or more readable.
+const (
+	shortIdentLen    = 2
+	readableIdentLen = 6
+)
+
+// shortTopLevels are short first segments of package names that are
+// reverse-DNS prefixes rather than obfuscated identifiers.
+var shortTopLevels = StrMap("io", "me", "co", "tv", "ai", "de", "fr", "uk", "jp", "cn", "ru", "nl", "it", "es", "us")
+
+// ObfuscationScore estimates how obfuscated the package names packages are,
+// such as those in App.Packages, from 0 for none to 1 for fully obfuscated
+// names like "a.a.a" or "o.o". Names may be separated by dots or slashes.
+//
+// The score is the mean of two measures over every segment of the names:
+//   - the ratio of segments one or two characters long; and
+//   - how short segments are on average, from 0 for an average of six
+//     characters or more to 1 for an average of two or fewer.
+//
+// Short reverse-DNS prefixes such as the "io" of "io.fabric" are ignored as
+// first segments. An empty list scores 0.
+func ObfuscationScore(packages []string) float64 {
+	var segments, short, length int
+	for _, pkg := range packages {
+		for i, seg := range strings.FieldsFunc(pkg, func(r rune) bool { return r == '.' || r == '/' }) {
+			if _, ok := shortTopLevels[seg]; i == 0 && ok {
+				continue
+			}
+			segments++
+			length += len(seg)
+			if len(seg) <= shortIdentLen {
+				short++
+			}
+		}
+	}
+	if segments == 0 {
+		return 0
+	}
+
+	shortRatio := float64(short) / float64(segments)
+	avgLen := float64(length) / float64(segments)
+	lengthScore := (readableIdentLen - avgLen) / (readableIdentLen - shortIdentLen)
+	if lengthScore < 0 {
+		lengthScore = 0
+	} else if lengthScore > 1 {
+		lengthScore = 1
+	}
+	return (shortRatio + lengthScore) / 2
+}
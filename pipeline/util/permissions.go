@@ -0,0 +1,112 @@
+package util
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"strings"
+)
+
+// androidPermissionsCSV lists Android's standard permissions with the
+// category and protection level of each, as id,category,protection_level.
+//
+//go:embed permissions.csv
+var androidPermissionsCSV string
+
+// permissionClass is the category and protection level of a permission.
+type permissionClass struct {
+	category        string
+	protectionLevel string
+}
+
+// androidPermissions maps the IDs in androidPermissionsCSV to their class.
+var androidPermissions = func() map[string]permissionClass {
+	records, err := csv.NewReader(strings.NewReader(androidPermissionsCSV)).ReadAll()
+	if err != nil {
+		panic("invalid permissions.csv: " + err.Error())
+	}
+	ret := make(map[string]permissionClass, len(records))
+	for _, record := range records[1:] {
+		ret[record[0]] = permissionClass{record[1], record[2]}
+	}
+	return ret
+}()
+
+// PermissionCategory returns the category of the Android permission id, such
+// as "location" or "network", and its protection level: "normal", "dangerous"
+// or "signature". Both are "unknown" for permissions that aren't part of
+// Android, such as those defined by apps or device vendors.
+func PermissionCategory(id string) (category string, protectionLevel string) {
+	if class, ok := androidPermissions[id]; ok {
+		return class.category, class.protectionLevel
+	}
+	return "unknown", "unknown"
+}
+
+// PermissionChange is a permission requested by two versions of an app with
+// different maximum SDK versions.
+type PermissionChange struct {
+	Old Permission
+	New Permission
+}
+
+// permissionIndex maps the IDs of perms to their first occurrence in perms.
+func permissionIndex(perms []Permission) map[string]Permission {
+	idx := make(map[string]Permission, len(perms))
+	for _, perm := range perms {
+		if _, ok := idx[perm.ID]; !ok {
+			idx[perm.ID] = perm
+		}
+	}
+	return idx
+}
+
+// PermissionDiff compares the permissions requested by two versions of an
+// app by ID, returning the permissions in new that aren't in old, in the order
+// new requests them, and those in old that aren't in new, in the order old
+// requests them. Permissions whose MaxSdkVer changed are in neither; see
+// PermissionChanges.
+func PermissionDiff(old, new []Permission) (added, removed []Permission) {
+	oldIdx, newIdx := permissionIndex(old), permissionIndex(new)
+
+	seen := make(map[string]Unit, len(new))
+	for _, perm := range new {
+		if _, ok := seen[perm.ID]; ok {
+			continue
+		}
+		seen[perm.ID] = unit
+		if _, ok := oldIdx[perm.ID]; !ok {
+			added = append(added, perm)
+		}
+	}
+
+	seen = make(map[string]Unit, len(old))
+	for _, perm := range old {
+		if _, ok := seen[perm.ID]; ok {
+			continue
+		}
+		seen[perm.ID] = unit
+		if _, ok := newIdx[perm.ID]; !ok {
+			removed = append(removed, perm)
+		}
+	}
+	return added, removed
+}
+
+// PermissionChanges returns the permissions requested by both old and new
+// whose MaxSdkVer differs between them, in the order new requests them.
+func PermissionChanges(old, new []Permission) []PermissionChange {
+	oldIdx := permissionIndex(old)
+
+	var changed []PermissionChange
+	seen := make(map[string]Unit, len(new))
+	for _, perm := range new {
+		if _, ok := seen[perm.ID]; ok {
+			continue
+		}
+		seen[perm.ID] = unit
+		if oldPerm, ok := oldIdx[perm.ID]; ok && oldPerm.MaxSdkVer != perm.MaxSdkVer {
+			changed = append(changed, PermissionChange{oldPerm, perm})
+		}
+	}
+	return changed
+}
@@ -0,0 +1,116 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// reflectionRefs are the smali references that indicate an app uses
+// reflection or loads code dynamically.
+var reflectionRefs = []string{
+	"Ljava/lang/reflect/",
+	"Ljava/lang/Class;->forName",
+	"Ldalvik/system/DexClassLoader",
+}
+
+// ErrNoSmali is returned by DetectReflection when the app was unpacked
+// without disassembling its code.
+var ErrNoSmali = errors.New("no smali output")
+
+// maxSmaliLine is the longest smali line DetectReflection can scan.
+const maxSmaliLine = 1024 * 1024
+
+// DetectReflection scans the smali output of the unpacked app for uses of
+// reflection, Class.forName and DexClassLoader. It sets app.UsesReflect and
+// returns whether any were found, along with where, as "file:line" with file
+// relative to OutDir. It must be called after Unpack, and returns ErrNoSmali
+// if the app's code wasn't disassembled.
+func (app *App) DetectReflection() (bool, []string, error) {
+	outDir := app.OutDir()
+	dirs, err := smaliDirs(outDir)
+	if err != nil {
+		return false, nil, err
+	}
+
+	var sites []string
+	for _, dir := range dirs {
+		err = filepath.Walk(dir, func(fname string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || path.Ext(fname) != ".smali" {
+				return nil
+			}
+
+			found, err := scanSmali(fname)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(outDir, fname)
+			for _, line := range found {
+				sites = append(sites, fmt.Sprintf("%s:%d", rel, line))
+			}
+			return nil
+		})
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	app.UsesReflect = len(sites) > 0
+	return app.UsesReflect, sites, nil
+}
+
+// smaliDirs returns the directories in outDir holding smali output, or
+// ErrNoSmali if there aren't any. Multidex apps have smali, smali_classes2,
+// smali_classes3 and so on.
+func smaliDirs(outDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(outDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, e := range entries {
+		if e.IsDir() && (e.Name() == "smali" || strings.HasPrefix(e.Name(), "smali_")) {
+			dirs = append(dirs, path.Join(outDir, e.Name()))
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, ErrNoSmali
+	}
+	return dirs, nil
+}
+
+// scanSmali returns the numbers of the lines of the smali file fname that
+// contain one of reflectionRefs. The file is read a line at a time.
+func scanSmali(fname string) ([]int, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []int
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxSmaliLine)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		for _, ref := range reflectionRefs {
+			if strings.Contains(line, ref) {
+				lines = append(lines, n)
+				break
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't scan %s: %s", fname, err.Error())
+	}
+	return lines, nil
+}
@@ -0,0 +1,92 @@
+package util
+
+import (
+	"bytes"
+	"sort"
+)
+
+// appReport is the document written by MarshalReport.
+type appReport struct {
+	*App
+	SHA256           string  `json:"sha256"`
+	ApktoolVersion   string  `json:"apktoolVersion"`
+	ObfuscationScore float64 `json:"obfuscationScore"`
+}
+
+// MarshalReport encodes the results of analysing the app as an indented JSON
+// document for archiving, along with the SHA-256 digest of its APK, the
+// version of apktool found by CheckApktool and the ObfuscationScore of its
+// Packages. The document only depends on what was found in the app, so that
+// those of two versions can be diffed: Path and UnpackDir, which depend on
+// where the app was analyzed, are left out, Splits are given by SplitName, and
+// Perms, Hosts, HostIPs, CleartextHosts, Packages and the permissions of each
+// split are sorted. It is written by WriteJSONIndent, so URLs in it aren't
+// escaped.
+func (app *App) MarshalReport() ([]byte, error) {
+	hash, err := app.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy the fields rather than the App, whose mutex can't be copied.
+	report := appReport{
+		App: &App{
+			DBID:               app.DBID,
+			ID:                 app.ID,
+			Store:              app.Store,
+			Region:             app.Region,
+			Ver:                app.Ver,
+			Perms:              sortedPerms(app.Perms),
+			Hosts:              sortedStrings(app.Hosts),
+			Packages:           sortedStrings(app.Packages),
+			Icon:               app.Icon,
+			UsesReflect:        app.UsesReflect,
+			APKLocationUUID:    app.APKLocationUUID,
+			APKLocationPath:    app.APKLocationPath,
+			APKLocationRoot:    app.APKLocationRoot,
+			CleartextHosts:     sortedStrings(app.CleartextHosts),
+			HostIPs:            sortedStrings(app.HostIPs),
+			ResourcesUndecoded: app.ResourcesUndecoded,
+		},
+		SHA256:           hash,
+		ApktoolVersion:   ApktoolVersion(),
+		ObfuscationScore: ObfuscationScore(app.Packages),
+	}
+	for _, split := range app.Splits {
+		report.Splits = append(report.Splits, SplitName(split))
+	}
+	sort.Strings(report.Splits)
+	if len(app.SplitPerms) > 0 {
+		report.SplitPerms = make(map[string][]Permission, len(app.SplitPerms))
+		for split, perms := range app.SplitPerms {
+			report.SplitPerms[split] = sortedPerms(perms)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteJSONIndent(&buf, report, "  "); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sortedStrings returns a sorted copy of strs, which is empty rather than nil
+// so that it is encoded as [] rather than null.
+func sortedStrings(strs []string) []string {
+	ret := append([]string{}, strs...)
+	sort.Strings(ret)
+	return ret
+}
+
+// sortedPerms returns a copy of perms sorted by ID, then MaxSdkVer, which is
+// empty rather than nil.
+func sortedPerms(perms []Permission) []Permission {
+	ret := append([]Permission{}, perms...)
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].ID != ret[j].ID {
+			return ret[i].ID < ret[j].ID
+		}
+		return ret[i].MaxSdkVer < ret[j].MaxSdkVer
+	})
+	return ret
+}
@@ -0,0 +1,84 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LoadKnownSDKs reads a JSON object mapping package prefixes to the names of
+// the SDKs they belong to, e.g. {"com.google.firebase": "Firebase"}, for use
+// with DetectSDKs.
+func LoadKnownSDKs(fname string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read known SDKs: %s", err.Error())
+	}
+	var sdks map[string]string
+	if err := json.Unmarshal(data, &sdks); err != nil {
+		return nil, fmt.Errorf("couldn't parse known SDKs %s: %s", fname, err.Error())
+	}
+	return sdks, nil
+}
+
+// sdkPackagePath converts a package prefix, written either as
+// "com.google.firebase" or "com/google/firebase", to the latter.
+func sdkPackagePath(prefix string) string {
+	return strings.Trim(strings.Replace(prefix, ".", "/", -1), "/")
+}
+
+// DetectSDKs returns the entries of knownSDKs, which maps package prefixes
+// to SDK names, whose packages are embedded in the unpacked app. If the app's
+// code was disassembled, a prefix matches if the smali output has a
+// directory for it; otherwise the app's classes*.dex files (and those of its
+// splits) are searched for classes in the package. It must be called after
+// Unpack.
+func (app *App) DetectSDKs(knownSDKs map[string]string) map[string]string {
+	found := make(map[string]string)
+	outDir := app.OutDir()
+
+	dirs, err := smaliDirs(outDir)
+	if err == nil {
+		for prefix, sdk := range knownSDKs {
+			for _, dir := range dirs {
+				if fi, err := os.Stat(path.Join(dir, sdkPackagePath(prefix))); err == nil && fi.IsDir() {
+					found[prefix] = sdk
+					break
+				}
+			}
+		}
+		return found
+	}
+	if err != ErrNoSmali {
+		Log.Warning("Couldn't list the smali output of %s: %s", app.ID, err.Error())
+		return found
+	}
+
+	dexDirs := []string{outDir}
+	for _, split := range app.Splits {
+		dexDirs = append(dexDirs, app.SplitDir(split))
+	}
+	for _, dir := range dexDirs {
+		dexes, _ := filepath.Glob(path.Join(dir, "classes*.dex"))
+		for _, dex := range dexes {
+			data, err := ioutil.ReadFile(dex)
+			if err != nil {
+				Log.Warning("Couldn't read %s: %s", dex, err.Error())
+				continue
+			}
+			// Classes appear in the dex string table as type descriptors,
+			// e.g. Lcom/google/firebase/FirebaseApp;.
+			for prefix, sdk := range knownSDKs {
+				if bytes.Contains(data, []byte("L"+sdkPackagePath(prefix)+"/")) {
+					found[prefix] = sdk
+				}
+			}
+		}
+	}
+	return found
+}
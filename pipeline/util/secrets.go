@@ -0,0 +1,190 @@
+package util
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// defaultSecretPatternsJSON lists the patterns returned by
+// DefaultSecretPatterns, in the format read by LoadSecretPatterns.
+//
+//go:embed secret_patterns.json
+var defaultSecretPatternsJSON []byte
+
+// Limits on the work ScanSecrets does for each file.
+const (
+	// maxSecretScanLen is the number of bytes at the start of each file that
+	// are scanned.
+	maxSecretScanLen = 1024 * 1024
+	// maxSecretMatches is the number of matches reported for each file.
+	maxSecretMatches = 100
+)
+
+// Pattern is a named regexp matching a kind of secret, such as an API key.
+type Pattern struct {
+	Name string
+	Re   *regexp.Regexp
+}
+
+// UnmarshalJSON decodes a pattern from an object such as
+// {"name": "google_api_key", "regexp": "AIza[0-9A-Za-z_-]{35}"}.
+func (p *Pattern) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Name   string `json:"name"`
+		Regexp string `json:"regexp"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw.Name == "" || raw.Regexp == "" {
+		return fmt.Errorf("pattern %s must have a name and a regexp", data)
+	}
+	re, err := regexp.Compile(raw.Regexp)
+	if err != nil {
+		return fmt.Errorf("invalid regexp for pattern %s: %s", raw.Name, err.Error())
+	}
+	p.Name, p.Re = raw.Name, re
+	return nil
+}
+
+// SecretMatch is a secret found by ScanSecrets: the name of the Pattern it
+// matched, the file and line it is on, and a Preview of it with all but its
+// first few characters masked.
+type SecretMatch struct {
+	Pattern string `json:"pattern"`
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+	Preview string `json:"preview"`
+}
+
+// DefaultSecretPatterns returns the built in patterns, which match AWS access
+// key IDs, Google API keys, Stripe and Slack tokens, and PEM encoded private
+// keys and certificates.
+func DefaultSecretPatterns() []Pattern {
+	var patterns []Pattern
+	if err := json.Unmarshal(defaultSecretPatternsJSON, &patterns); err != nil {
+		panic("invalid secret_patterns.json: " + err.Error())
+	}
+	return patterns
+}
+
+// LoadSecretPatterns reads a JSON array of patterns, each an object with a
+// name and a regexp, for use with ScanSecrets along with or instead of
+// DefaultSecretPatterns.
+func LoadSecretPatterns(fname string) ([]Pattern, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read secret patterns: %s", err.Error())
+	}
+	var patterns []Pattern
+	if err := json.Unmarshal(data, &patterns); err != nil {
+		return nil, fmt.Errorf("couldn't parse secret patterns %s: %s", fname, err.Error())
+	}
+	return patterns, nil
+}
+
+// ScanSecrets scans the assets and res directories of the unpacked app, and
+// of its Splits, for matches of patterns, returning them in the order they're
+// found. It must be called after Unpack.
+//
+// Binary files are skipped, and only the first megabyte of each file is
+// scanned, with at most 100 matches reported per file. PEM blocks and similar
+// secrets spanning several lines are matched, since a file is scanned as a
+// whole rather than a line at a time.
+func (app *App) ScanSecrets(patterns []Pattern) ([]SecretMatch, error) {
+	dirs := []string{app.OutDir()}
+	for _, split := range app.Splits {
+		dirs = append(dirs, app.SplitDir(split))
+	}
+
+	var matches []SecretMatch
+	for _, dir := range dirs {
+		for _, root := range []string{path.Join(dir, "assets"), path.Join(dir, "res")} {
+			if _, err := os.Stat(root); os.IsNotExist(err) {
+				continue
+			}
+			err := filepath.Walk(root, func(fname string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.Mode().IsRegular() {
+					return nil
+				}
+				found, err := scanSecrets(fname, patterns)
+				if err != nil {
+					return err
+				}
+				matches = append(matches, found...)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return matches, nil
+}
+
+// scanSecrets returns the matches of patterns in the file fname, or nothing if
+// it is binary.
+func scanSecrets(fname string, patterns []Pattern) ([]SecretMatch, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxSecretScanLen))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't scan %s: %s", fname, err.Error())
+	}
+	head := data
+	if len(head) > binarySniffLen {
+		head = head[:binarySniffLen]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+
+	var matches []SecretMatch
+	for _, p := range patterns {
+		for _, loc := range p.Re.FindAllIndex(data, maxSecretMatches-len(matches)) {
+			matches = append(matches, SecretMatch{
+				Pattern: p.Name,
+				Path:    fname,
+				Line:    bytes.Count(data[:loc[0]], []byte{'\n'}) + 1,
+				Preview: redact(string(data[loc[0]:loc[1]])),
+			})
+		}
+		if len(matches) >= maxSecretMatches {
+			Log.Debug("Skipping the rest of %s: too many secrets", fname)
+			break
+		}
+	}
+	return matches, nil
+}
+
+// redact masks all but the first four characters of secret, or all of it if
+// it is eight characters or shorter. At most 16 characters are masked, so
+// previews of long secrets stay short.
+func redact(secret string) string {
+	runes := []rune(secret)
+	shown := 4
+	if len(runes) <= 2*shown {
+		shown = 0
+	}
+	masked := len(runes) - shown
+	if masked > 16 {
+		masked = 16
+	}
+	return string(runes[:shown]) + strings.Repeat("*", masked)
+}
@@ -0,0 +1,172 @@
+package util
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxSocketRequest is the longest request line ServeSocket accepts.
+const maxSocketRequest = 1024 * 1024
+
+// SocketRequest is a request to a server started with ServeSocket. Requests
+// are written to the socket as JSON objects, one per line, and each is
+// answered with a SocketResponse line in the order they were sent. ID is
+// copied to the response as is, and may be omitted.
+type SocketRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// SocketResponse is the answer to a SocketRequest: either the Result returned
+// by the handler, or the Error it failed with.
+type SocketResponse struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Result interface{}     `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// SocketHandler handles a request read by ServeSocket, returning a result
+// that can be encoded as JSON. It is called concurrently for requests made on
+// different connections.
+type SocketHandler func(req SocketRequest) (interface{}, error)
+
+// SocketServer is a server started with ServeSocket.
+type SocketServer struct {
+	path    string
+	l       net.Listener
+	handler SocketHandler
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	conns  map[net.Conn]Unit
+	closed bool
+}
+
+// ServeSocket serves handler on the Unix domain socket at path, such as
+// Cfg.SockPath, in the background. A socket left there by a previous server
+// that didn't shut down cleanly is replaced, but it is an error for another
+// server to still be listening on it. Close must be called to stop the server
+// and remove the socket.
+func ServeSocket(path string, handler SocketHandler) (*SocketServer, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another server is listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("couldn't remove stale socket %s: %s", path, err.Error())
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %s", path, err.Error())
+	}
+	s := &SocketServer{path: path, l: l, handler: handler, conns: make(map[net.Conn]Unit)}
+	s.wg.Add(1)
+	go s.accept()
+	Log.Info("Serving requests on %s", path)
+	return s, nil
+}
+
+// accept serves each connection made to the socket in its own goroutine until
+// the listener is closed.
+func (s *SocketServer) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if !closed {
+				Log.Err("Socket server on %s stopped: %s", s.path, err.Error())
+			}
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = unit
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// serve answers the requests made on conn until it is closed by the client or
+// by Close.
+func (s *SocketServer) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), maxSocketRequest)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req SocketRequest
+		var resp SocketResponse
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = "invalid request: " + err.Error()
+		} else {
+			resp.ID = req.ID
+			result, err := s.handler(req)
+			if err != nil {
+				resp.Error = err.Error()
+			} else {
+				resp.Result = result
+			}
+		}
+		if err := enc.Encode(resp); err != nil {
+			Log.Warning("Couldn't write response on %s: %s", s.path, err.Error())
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil && !isTimeout(err) {
+		Log.Warning("Couldn't read request on %s: %s", s.path, err.Error())
+	}
+}
+
+// isTimeout reports whether err is a network timeout, which Close causes to
+// stop reading from connections.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// Close stops accepting connections and waits for the requests being handled
+// to be answered before closing every connection and removing the socket.
+func (s *SocketServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	err := s.l.Close()
+	// Interrupt reading the next request, letting the current one finish.
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	if rmErr := os.Remove(s.path); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+		err = rmErr
+	}
+	return err
+}
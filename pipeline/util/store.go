@@ -0,0 +1,204 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ArtifactStore stores the files of unpacked apps, such as their decoded
+// manifests and smali, so that they can be read on other machines than the one
+// that unpacked them. Keys are slash separated paths relative to the root of
+// the store, e.g. "com.example.app/play/us/1.0/AndroidManifest.xml".
+type ArtifactStore interface {
+	// Put stores the contents of r under key, replacing anything stored
+	// there before.
+	Put(key string, r io.Reader) error
+	// Get returns the contents stored under key. The error satisfies
+	// os.IsNotExist if nothing is.
+	Get(key string) (io.ReadCloser, error)
+	// List returns the keys starting with prefix, in lexical order.
+	List(prefix string) ([]string, error)
+}
+
+// LocalStore is an ArtifactStore keeping artifacts as files under Dir.
+type LocalStore struct {
+	Dir string
+}
+
+// file returns the path of the file key is stored in, or an error if key is
+// outside s.Dir.
+func (s LocalStore) file(key string) (string, error) {
+	clean := path.Clean("/" + key)[1:]
+	if clean == "" || clean != strings.TrimPrefix(key, "/") {
+		return "", fmt.Errorf("invalid artifact key %q", key)
+	}
+	return path.Join(s.Dir, clean), nil
+}
+
+// Put implements ArtifactStore. The file is written to a temporary file
+// first, so readers never see it partially written.
+func (s LocalStore) Put(key string, r io.Reader) error {
+	fname, err := s.file(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(fname), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(path.Dir(fname), "."+path.Base(fname)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fname)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Get implements ArtifactStore.
+func (s LocalStore) Get(key string) (io.ReadCloser, error) {
+	fname, err := s.file(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fname)
+}
+
+// List implements ArtifactStore.
+func (s LocalStore) List(prefix string) ([]string, error) {
+	// Only the directory the prefix ends in needs to be walked.
+	root := path.Join(s.Dir, path.Dir(prefix))
+	if rel, err := filepath.Rel(s.Dir, root); err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("invalid artifact prefix %q", prefix)
+	}
+
+	var keys []string
+	err := filepath.Walk(root, func(fname string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && fname == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, fname)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+var (
+	artifactStoreMu sync.Mutex
+	artifactStore   ArtifactStore
+)
+
+// SetArtifactStore sets the store Unpack copies unpacked apps to. Passing nil
+// restores the default, a LocalStore in Cfg.StorageConfig.APKUnpackDirectory,
+// which apps are unpacked into anyway.
+func SetArtifactStore(s ArtifactStore) {
+	artifactStoreMu.Lock()
+	artifactStore = s
+	artifactStoreMu.Unlock()
+}
+
+// Artifacts returns the store set with SetArtifactStore.
+func Artifacts() ArtifactStore {
+	artifactStoreMu.Lock()
+	defer artifactStoreMu.Unlock()
+	if artifactStore == nil {
+		return LocalStore{Cfg.StorageConfig.APKUnpackDirectory}
+	}
+	return artifactStore
+}
+
+// isUnpackDir reports whether s is a LocalStore in the directory apps are
+// unpacked into, so that unpacked files don't need to be copied to it.
+func isUnpackDir(s ArtifactStore) bool {
+	ls, ok := s.(LocalStore)
+	return ok && path.Clean(ls.Dir) == path.Clean(Cfg.StorageConfig.APKUnpackDirectory)
+}
+
+// ArtifactKey returns the prefix of the keys the app's unpacked files are
+// stored under, which is the path of OutDir relative to
+// Cfg.StorageConfig.APKUnpackDirectory.
+func (app *App) ArtifactKey() (string, error) {
+	outDir, err := app.OutDirErr()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(Cfg.StorageConfig.APKUnpackDirectory, outDir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s isn't in the unpack directory", outDir)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// OpenArtifact opens the file name, relative to OutDir, of the unpacked app
+// from the artifact store.
+func (app *App) OpenArtifact(name string) (io.ReadCloser, error) {
+	key, err := app.ArtifactKey()
+	if err != nil {
+		return nil, err
+	}
+	return Artifacts().Get(key + "/" + name)
+}
+
+// storeArtifacts copies the files in outDir to the artifact store, unless it
+// is the unpack directory they are already in.
+func (app *App) storeArtifacts(outDir string) error {
+	s := Artifacts()
+	if isUnpackDir(s) {
+		return nil
+	}
+	key, err := app.ArtifactKey()
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(outDir, func(fname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(outDir, fname)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(fname)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := s.Put(key+"/"+filepath.ToSlash(rel), f); err != nil {
+			return fmt.Errorf("couldn't store %s: %s", rel, err.Error())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// SweepStaleUnpackDirs removes the unpacked apps under
+// Cfg.StorageConfig.APKUnpackDirectory that haven't been modified for
+// olderThan, e.g. ones left behind by an analyzer that crashed before calling
+// Cleanup. Each entry of the unpack directory is removed if nothing in it is
+// newer than olderThan, except that the directories of LayoutContent are
+// removed one digest at a time. It returns the number of entries removed.
+func SweepStaleUnpackDirs(olderThan time.Duration) (int, error) {
+	unpackDir := Cfg.StorageConfig.APKUnpackDirectory
+	entries, err := ioutil.ReadDir(unpackDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var dirs []string
+	for _, e := range entries {
+		if e.IsDir() && e.Name() == "sha256" {
+			digests, err := filepath.Glob(path.Join(unpackDir, "sha256", "*", "*"))
+			if err != nil {
+				return 0, err
+			}
+			dirs = append(dirs, digests...)
+			continue
+		}
+		dirs = append(dirs, path.Join(unpackDir, e.Name()))
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	removed := 0
+	for _, p := range dirs {
+		newest, err := newestModTime(p)
+		if err != nil {
+			Log.Warning("Couldn't check unpack dir %s: %s", p, err.Error())
+			continue
+		}
+		if newest.After(cutoff) {
+			continue
+		}
+
+		if err = os.RemoveAll(p); err != nil {
+			Log.Warning("Couldn't remove stale unpack dir %s: %s", p, err.Error())
+			continue
+		}
+		Log.Debug("Removed stale unpack dir %s", p)
+		removed++
+	}
+	return removed, nil
+}
+
+// newestModTime returns the latest modification time of p and everything
+// under it.
+func newestModTime(p string) (time.Time, error) {
+	var newest time.Time
+	err := filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return newest, err
+}
@@ -1,18 +1,21 @@
 package util
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,25 +25,67 @@ type Unit struct{}
 var unit Unit
 
 // App Struct for holding of information extracted from the APK
+//
+// OutDir, OutDirErr, ApkPath and Hash may be called from several goroutines
+// at once: the unpack directory and digest they lazily compute are guarded
+// by a mutex, so every caller sees the same values. Everything else,
+// including setting the exported fields and methods that fill them in such
+// as Unpack and ParsePermissions, must not run concurrently with other uses
+// of the App. An App must not be copied after first use.
 type App struct {
-	DBID                   int64
-	ID, Store, Region, Ver string
-	Path, UnpackDir        string
-	Perms                  []Permission
-	Hosts                  []string
-	Packages               []string
-	Icon                   string
-	UsesReflect            bool
-	APKLocationUUID        string
-	APKLocationPath        string
-	APKLocationRoot        string
+	DBID            int64        `json:"dbID"`
+	ID              string       `json:"id"`
+	Store           string       `json:"store"`
+	Region          string       `json:"region"`
+	Ver             string       `json:"ver"`
+	Path            string       `json:"path,omitempty"`
+	UnpackDir       string       `json:"unpackDir,omitempty"`
+	Perms           []Permission `json:"perms"`
+	Hosts           []string     `json:"hosts"`
+	Packages        []string     `json:"packages"`
+	Icon            string       `json:"icon"`
+	UsesReflect     bool         `json:"usesReflect"`
+	APKLocationUUID string       `json:"apkLocationUUID"`
+	APKLocationPath string       `json:"apkLocationPath"`
+	APKLocationRoot string       `json:"apkLocationRoot"`
+
+	// CleartextHosts are the hosts of the http URLs found by ExtractHosts,
+	// which the app may contact without TLS; see CheckCleartext.
+	CleartextHosts []string `json:"cleartextHosts"`
+	// HostIPs are the IP addresses found by ExtractHosts in place of host
+	// names, which are looked up with GeoIP directly.
+	HostIPs []string `json:"hostIPs"`
+
+	// ResourcesUndecoded is set by Unpack if apktool failed to decode the
+	// resources of the APK or one of its splits, which was then unpacked
+	// with --no-res instead. Its res directory is missing, leaving only the
+	// raw resources.arsc, and its AndroidManifest.xml is binary XML unless
+	// apktool is at least 2.5.0.
+	ResourcesUndecoded bool `json:"resourcesUndecoded"`
+
+	// Splits are the paths of split APKs (configuration, language, density or
+	// feature splits) installed along with the base APK at ApkPath. Unpack
+	// decodes each of them into SplitDir, and ParsePermissions merges their
+	// permissions into Perms, recording those that only a split requests in
+	// SplitPerms.
+	Splits     []string                `json:"splits,omitempty"`
+	SplitPerms map[string][]Permission `json:"splitPerms,omitempty"`
+
+	// lazyMu guards the fields computed on first use: UnpackDir, when set by
+	// OutDirErr, and sha256.
+	lazyMu sync.Mutex
+	// sha256 caches the digest computed by Hash.
+	sha256 string
+	// spooled is set if Path is a temporary copy made by AppFromReader,
+	// which Cleanup removes.
+	spooled bool
 }
 
 // Permission Struct represents the permission information found
 // in an APK
 type Permission struct {
-	ID        string `xml:"name,attr"`
-	MaxSdkVer string `xml:"maxSdkVersion,attr"`
+	ID        string `xml:"name,attr" json:"id"`
+	MaxSdkVer string `xml:"maxSdkVersion,attr" json:"maxSdkVer,omitempty"`
 }
 
 // NewApp Constructs a new app. initialising values based on
@@ -57,13 +102,93 @@ func NewApp(dbID int64, id, store, region, ver, apkLocationPath, apkLocationRoot
 		APKLocationUUID: apkLocationUUID}
 }
 
+// ErrInvalidApp is returned (wrapped) by Validate, and so by Unpack, for apps
+// whose identity can't safely be used to build paths.
+var ErrInvalidApp = errors.New("invalid app")
+
+// Validate checks that the fields OutDir builds the app's unpack directory
+// from are usable: the ID, Store, Region and Ver of apps from the DB must be
+// set, and none of them may contain a path separator or be "." or "..", so
+// that malicious store metadata can't point outside the unpack directory.
+// Apps given by Path only need the path.
+func (app *App) Validate() error {
+	fields := []struct{ name, value string }{
+		{"ID", app.ID}, {"Store", app.Store}, {"Region", app.Region}, {"Ver", app.Ver},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			if app.Path != "" {
+				continue
+			}
+			return fmt.Errorf("%w: %s is empty", ErrInvalidApp, f.name)
+		}
+		if strings.ContainsAny(f.value, "/\\\x00") || f.value == "." || f.value == ".." {
+			return fmt.Errorf("%w: %s %q isn't a valid path component", ErrInvalidApp, f.name, f.value)
+		}
+	}
+	return nil
+}
+
 // AppByPath returns an App object with the Path value initialised.
 func AppByPath(path string) *App {
 	return &App{Path: path}
 }
 
-// AppDir returns the directory of the apk and other misc files.
+// AppFromReader returns an App for the APK read from r, e.g. a download from
+// object storage, with the given ID. The APK is spooled to a temporary file in
+// Cfg.StorageConfig.APKUnpackDirectory, which becomes the app's Path, so it
+// can be unpacked as usual; Cleanup removes it.
+func AppFromReader(id string, r io.Reader) (*App, error) {
+	f, err := ioutil.TempFile(Cfg.StorageConfig.APKUnpackDirectory, path.Base(id)+"-*.apk")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create a file for %s: %s", id, err.Error())
+	}
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("couldn't save the apk of %s: %s", id, err.Error())
+	}
+	return &App{ID: id, Path: f.Name(), spooled: true}, nil
+}
+
+// Layouts of the directories apps are unpacked to, selectable with the
+// storage_config.layout config option.
+const (
+	// LayoutLegacy keys the directories on the ID, Store, Region and Ver of
+	// apps from the DB, and uses a temporary directory for apps given by Path.
+	LayoutLegacy = "legacy"
+	// LayoutContent keys the directories on the SHA-256 digest of the APK, so
+	// that distinct APKs claiming the same version don't collide.
+	LayoutContent = "content"
+)
+
+// contentDir returns the directory of the APK with the given digest in
+// LayoutContent: sha256/<first two hex digits>/<digest> in
+// Cfg.StorageConfig.APKUnpackDirectory.
+func contentDir(hash string) string {
+	return path.Join(Cfg.StorageConfig.APKUnpackDirectory, "sha256", hash[:2], hash)
+}
+
+// AppDir returns the directory of the apk and other misc files. In
+// LayoutContent, it is the directory derived from the digest of the APK that
+// holds OutDir, and the APK itself stays where ApkPath finds it.
 func (app *App) AppDir() string {
+	if Cfg.StorageConfig.Layout == LayoutContent {
+		hash, err := app.Hash()
+		if err == nil {
+			return contentDir(hash)
+		}
+		Log.Err("Couldn't hash the apk of %s, using the legacy layout: %s", app.ID, err.Error())
+	}
+	return app.legacyAppDir()
+}
+
+// legacyAppDir returns AppDir in LayoutLegacy: the directory of the APK.
+func (app *App) legacyAppDir() string {
 	if app.Path != "" {
 		return path.Dir(app.Path)
 	}
@@ -83,10 +208,15 @@ func getUUIDMountPath(UUID string) string {
 // starting with the location specified in the DB, falling down to checking
 // locations with the root of the path specidied in the DB substituted,
 // follewed by checking each location in the config forming a path from the
-// app version details.
+// app version details. If the app has a Path, that is used instead.
 func (app *App) ApkPath() string {
 	fmt.Println("Getting APK Path for App:", app.ID)
 
+	// Apps given by path, rather than found in the DB, are always there.
+	if app.Path != "" {
+		return app.Path
+	}
+
 	apkLocation := path.Join(app.APKLocationPath, app.ID+".apk")
 	fmt.Println("Checking if APK is at: ", apkLocation)
 
@@ -118,43 +248,105 @@ func (app *App) ApkPath() string {
 		}
 	}
 
-	if app.Path != "" {
-		return app.Path
-	}
 	return path.Join(app.AppDir(), app.ID+".apk")
 }
 
 // OutDir specifies where Apps should be unpacked to. it also creates
 // the directory structure for that path and returns the path as a
-// string.
+// string. If the directory can't be created, the error is logged and the
+// empty string is returned; use OutDirErr to handle the error instead.
+// Where it is depends on Cfg.StorageConfig.Layout: in LayoutContent, it is
+// the out directory in AppDir, whether or not the app is given by Path.
 func (app *App) OutDir() string {
+	dir, err := app.OutDirErr()
+	if err != nil {
+		Log.Err("%s", err.Error())
+		return ""
+	}
+	return dir
+}
+
+// OutDirErr is like OutDir, but returns an error if the directory can't be
+// created.
+func (app *App) OutDirErr() (string, error) {
+	// Hash takes lazyMu, so the digest is computed before locking it.
+	var hash string
+	app.lazyMu.Lock()
+	unpackDir := app.UnpackDir
+	app.lazyMu.Unlock()
+	if unpackDir == "" && Cfg.StorageConfig.Layout == LayoutContent {
+		var err error
+		if hash, err = app.Hash(); err != nil {
+			return "", fmt.Errorf("couldn't hash the apk of %s: %s", app.ID, err.Error())
+		}
+	}
+
+	app.lazyMu.Lock()
+	defer app.lazyMu.Unlock()
+
 	if app.UnpackDir == "" {
-		if app.Path != "" {
-			var err error
-			app.UnpackDir, err = ioutil.TempDir(Cfg.StorageConfig.APKUnpackDirectory, path.Base(app.Path))
+		if hash != "" {
+			dir := path.Join(contentDir(hash), "out")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return "", fmt.Errorf("failed to create temp dir in %s: %s", dir, err.Error())
+			}
+			app.UnpackDir = dir
+		} else if app.Path != "" {
+			dir, err := ioutil.TempDir(Cfg.StorageConfig.APKUnpackDirectory, path.Base(app.Path))
 			if err != nil {
-				// maybe do something else?
-				log.Fatal("Failed to create temp dir in ", Cfg.StorageConfig.APKUnpackDirectory, ": ", err)
+				return "", fmt.Errorf("failed to create temp dir in %s: %s",
+					Cfg.StorageConfig.APKUnpackDirectory, err.Error())
 			}
+			app.UnpackDir = dir
 		} else {
-			app.UnpackDir = path.Join(Cfg.StorageConfig.APKUnpackDirectory, app.ID, app.Store, app.Region, app.Ver)
-			if err := os.MkdirAll(app.UnpackDir, 0755); err != nil {
-				log.Fatalf("Failed to create temp dir in %s: %s", app.UnpackDir, err.Error())
+			dir := path.Join(Cfg.StorageConfig.APKUnpackDirectory, app.ID, app.Store, app.Region, app.Ver)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return "", fmt.Errorf("failed to create temp dir in %s: %s", dir, err.Error())
 			}
+			app.UnpackDir = dir
 		}
 	}
-	return app.UnpackDir
+	return app.UnpackDir, nil
 }
 
+// ErrUnpackTimeout is returned (wrapped) by Unpack and UnpackContext when
+// apktool doesn't finish in time.
+var ErrUnpackTimeout = errors.New("timed out unpacking apk")
+
 // Unpack passes an app to apktool to disassemble an APK. the contents are
-// stored in the path specified by OutDir.
+// stored in the path specified by OutDir. apktool is killed if it runs for
+// longer than Cfg.UnpackTimeout.
 func (app *App) Unpack() error {
-	apkPath, outDir := app.ApkPath(), app.OutDir()
-	if _, err := os.Stat(apkPath); err != nil {
-		if os.IsNotExist(err) {
-			return err
+	ctx, cancel := context.WithTimeout(context.Background(), Cfg.UnpackTimeout)
+	defer cancel()
+	return app.UnpackContext(ctx)
+}
+
+// UnpackContext is like Unpack, but apktool is killed when ctx is done. If
+// apktool fails or is killed, the partially written OutDir is removed. APKs
+// whose resources apktool can't decode are unpacked without them, setting
+// app.ResourcesUndecoded.
+// Android App Bundles (.aab) are converted to a universal APK with bundletool
+// before unpacking. Nothing is run if OutDir already holds a decode of the
+// same APK (see skipIfUnpacked), unless Cfg.ForceUnpack is set. Apps that
+// fail Validate aren't unpacked. Once unpacked, OutDir is copied to the store
+// set with SetArtifactStore, if any.
+func (app *App) UnpackContext(ctx context.Context) error {
+	if err := app.Validate(); err != nil {
+		return err
+	}
+	apkPath := app.ApkPath()
+	outDir, err := app.OutDirErr()
+	if err != nil {
+		return err
+	}
+	for _, p := range append([]string{apkPath}, app.Splits...) {
+		if _, err := os.Stat(p); err != nil {
+			if os.IsNotExist(err) {
+				return err
+			}
+			return fmt.Errorf("couldn't open apk %s: %s", p, err.Error())
 		}
-		return fmt.Errorf("couldn't open apk %s: %s", apkPath, err.Error())
 	}
 
 	if err := os.MkdirAll(path.Dir(outDir), 0755); err != nil {
@@ -165,100 +357,332 @@ func (app *App) Unpack() error {
 		return os.ErrPermission
 	}
 
-	cmd := exec.Command("apktool", "d", "-s", apkPath, "-o", outDir, "-f")
-	out, err := cmd.CombinedOutput()
+	if !Cfg.ForceUnpack && app.skipIfUnpacked(outDir) {
+		Log.Debug("Skipping unpacking %s, already unpacked in %s", apkPath, outDir)
+		return nil
+	}
+
+	// apktool can't decode app bundles, so build a universal APK first.
+	if IsBundle(apkPath) {
+		bundlePath := apkPath
+		workDir, err := ioutil.TempDir(path.Dir(outDir), path.Base(bundlePath))
+		if err != nil {
+			return fmt.Errorf("couldn't create bundletool work dir in %s: %w", path.Dir(outDir), err)
+		}
+		defer os.RemoveAll(workDir)
+
+		apkPath, err = buildUniversalAPK(ctx, bundlePath, workDir)
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("%w %s", ErrUnpackTimeout, bundlePath)
+			}
+			return fmt.Errorf("couldn't convert app bundle: %s", err.Error())
+		}
+	}
+
+	undecoded, err := runApktool(ctx, apkPath, outDir)
+	if err != nil {
+		return err
+	}
+	app.ResourcesUndecoded = undecoded
+
+	// Splits are decoded after the base, since apktool replaces outDir.
+	for _, split := range app.Splits {
+		undecoded, err := runApktool(ctx, split, app.SplitDir(split))
+		if err != nil {
+			os.RemoveAll(outDir)
+			return fmt.Errorf("split %s: %w", path.Base(split), err)
+		}
+		app.ResourcesUndecoded = app.ResourcesUndecoded || undecoded
+	}
+
+	// Record what was unpacked so that later runs can skip it.
+	hash, err := app.Hash()
+	if err != nil {
+		Log.Warning("Couldn't hash %s, it will be unpacked again next time: %s", apkPath, err.Error())
+		return app.storeArtifacts(outDir)
+	}
+	if err := ioutil.WriteFile(path.Join(outDir, unpackedMarker), []byte(hash+"\n"), 0644); err != nil {
+		Log.Warning("Couldn't record unpacking %s: %s", apkPath, err.Error())
+	}
+	return app.storeArtifacts(outDir)
+}
+
+// unpackedMarker is the file in OutDir recording the SHA-256 digest of the
+// APK unpacked there.
+const unpackedMarker = ".xray-unpacked"
+
+// skipIfUnpacked reports whether outDir already holds a complete decode of
+// the app's APK and splits from a previous Unpack: each was fully decoded by
+// apktool, none of the APKs were modified since, and the digest of the APK is
+// the one recorded when it was unpacked. If so, app.ResourcesUndecoded is set
+// as that Unpack set it.
+func (app *App) skipIfUnpacked(outDir string) bool {
+	marker, err := os.Stat(path.Join(outDir, unpackedMarker))
+	if err != nil {
+		return false
+	}
+
+	if !isDecoded(outDir) {
+		return false
+	}
+	for _, split := range app.Splits {
+		if !isDecoded(app.SplitDir(split)) {
+			return false
+		}
+	}
+
+	for _, p := range append([]string{app.ApkPath()}, app.Splits...) {
+		fi, err := os.Stat(p)
+		if err != nil || !fi.ModTime().Before(marker.ModTime()) {
+			return false
+		}
+	}
+
+	recorded, err := ioutil.ReadFile(path.Join(outDir, unpackedMarker))
+	if err != nil {
+		return false
+	}
+	hash, err := app.Hash()
+	if err != nil || strings.TrimSpace(string(recorded)) != hash {
+		return false
+	}
+
+	app.ResourcesUndecoded = resourcesRaw(outDir)
+	for _, split := range app.Splits {
+		app.ResourcesUndecoded = app.ResourcesUndecoded || resourcesRaw(app.SplitDir(split))
+	}
+	return true
+}
+
+// resourcesRaw reports whether dir holds an APK unpacked with --no-res, which
+// leaves resources.arsc undecoded instead of writing a res directory.
+func resourcesRaw(dir string) bool {
+	_, arscErr := os.Stat(path.Join(dir, "resources.arsc"))
+	_, resErr := os.Stat(path.Join(dir, "res"))
+	return arscErr == nil && os.IsNotExist(resErr)
+}
+
+// isDecoded reports whether dir holds the output of apktool, i.e. an
+// apktool.yml and a decoded (text rather than binary XML) AndroidManifest.xml.
+func isDecoded(dir string) bool {
+	if _, err := os.Stat(path.Join(dir, "apktool.yml")); err != nil {
+		return false
+	}
+
+	f, err := os.Open(path.Join(dir, "AndroidManifest.xml"))
 	if err != nil {
-		return fmt.Errorf("%s unpacking apk; output below:\n%s",
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, 64)
+	n, _ := io.ReadFull(f, buf)
+	start := strings.TrimSpace(string(buf[:n]))
+	return strings.HasPrefix(start, "<")
+}
+
+// SplitName returns the name a split APK is known by, i.e. its file name
+// without the extension, e.g. "config.arm64_v8a".
+func SplitName(split string) string {
+	return strings.TrimSuffix(path.Base(split), path.Ext(split))
+}
+
+// SplitDir returns the directory the split APK split is unpacked to, which is
+// OutDir()/splits/<SplitName(split)>. Anything found under it comes from
+// that split rather than the base APK.
+func (app *App) SplitDir(split string) string {
+	return path.Join(app.OutDir(), "splits", SplitName(split))
+}
+
+// runApktool decodes the APK at apkPath into outDir, leaving the code in
+// classes.dex. If apktool fails to decode its resources, it is run again with
+// --no-res, and resourcesUndecoded is set, unless it failed because a
+// framework isn't installed, which is an error wrapping ErrFrameworkMissing.
+// outDir is removed if apktool fails or ctx is done before it finishes.
+func runApktool(ctx context.Context, apkPath, outDir string) (resourcesUndecoded bool, err error) {
+	args := append([]string{"d", "-s", apkPath, "-o", outDir, "-f"}, frameworkArgs()...)
+	out, err := exec.CommandContext(ctx, Cfg.ApktoolPath, args...).CombinedOutput()
+	if err != nil && ctx.Err() == nil {
+		if fwErr := frameworkError(apkPath, out); fwErr != nil {
+			os.RemoveAll(outDir)
+			return false, fwErr
+		}
+	}
+	if err != nil && ctx.Err() == nil && resourceErrorRe.Match(out) {
+		Log.Warning("Couldn't decode the resources of %s, unpacking it without them", apkPath)
+		resourcesUndecoded = true
+		args = append(args, noResArgs()...)
+		out, err = exec.CommandContext(ctx, Cfg.ApktoolPath, args...).CombinedOutput()
+	}
+	if err != nil {
+		os.RemoveAll(outDir)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if ctxErr == context.DeadlineExceeded {
+				return false, fmt.Errorf("%w %s", ErrUnpackTimeout, apkPath)
+			}
+			return false, fmt.Errorf("unpacking apk %s: %w", apkPath, ctxErr)
+		}
+		return false, fmt.Errorf("%s unpacking apk; output below:\n%s",
 			err.Error(), string(out))
 	}
-	return nil
+	return resourcesUndecoded, nil
+}
+
+// Hash returns the hex encoded SHA-256 digest of the app's APK. The digest is
+// cached, so it is only computed again if Hash is called concurrently before
+// the first call finishes.
+func (app *App) Hash() (string, error) {
+	app.lazyMu.Lock()
+	hash := app.sha256
+	app.lazyMu.Unlock()
+	if hash != "" {
+		return hash, nil
+	}
+
+	f, err := os.Open(app.ApkPath())
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	hash = hex.EncodeToString(h.Sum(nil))
+
+	// Concurrent callers may each have hashed the APK, but they all get the
+	// same digest.
+	app.lazyMu.Lock()
+	app.sha256 = hash
+	app.lazyMu.Unlock()
+	return hash, nil
 }
 
-// Cleanup removes all directories specifed in an app object's OutDir.
+// Cleanup removes all directories specifed in an app object's OutDir, along
+// with the APK if it was spooled by AppFromReader. The copy of OutDir in a
+// store set with SetArtifactStore is kept.
 func (app *App) Cleanup() error {
-	return os.RemoveAll(app.OutDir())
+	err := os.RemoveAll(app.OutDir())
+	if app.spooled {
+		if rmErr := os.Remove(app.Path); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+			err = rmErr
+		}
+	}
+	return err
 }
 
-// CheckDir verifies that a Dir is a Dir and exists.
-func CheckDir(dir, name string) {
+// CleanupExcept is Cleanup, but first moves the files keep from OutDir to
+// AppDir, where they are kept at the same path relative to it, so that small
+// outputs like the manifest can be archived while the rest of the unpacked app
+// is removed. Files in keep are given relative to OutDir, or as absolute paths
+// inside it, and those that don't exist are skipped. Nothing is removed if any
+// of them can't be moved.
+func (app *App) CleanupExcept(keep ...string) error {
+	outDir := app.OutDir()
+	for _, name := range keep {
+		rel := path.Clean(name)
+		if path.IsAbs(rel) {
+			rel = strings.TrimPrefix(rel, path.Clean(outDir)+"/")
+		}
+		if path.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("couldn't keep %s: not in %s", name, outDir)
+		}
+
+		src, dst := path.Join(outDir, rel), path.Join(app.AppDir(), rel)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			Log.Debug("Not keeping %s of %s: it doesn't exist", rel, app.ID)
+			continue
+		}
+		if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("couldn't keep %s: %s", rel, err.Error())
+		}
+		if err := moveFile(src, dst); err != nil {
+			return fmt.Errorf("couldn't keep %s: %s", rel, err.Error())
+		}
+	}
+	return app.Cleanup()
+}
+
+// moveFile moves the file src to dst, copying it if they are on different
+// filesystems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// CheckDir verifies that a Dir is a Dir and exists, creating it if it
+// doesn't exist.
+func CheckDir(dir, name string) error {
 	fif, err := os.Stat(dir)
 	if err != nil {
-		if os.IsNotExist(err) {
-			err = os.MkdirAll(dir, 0644)
-			if err != nil {
-				//TODO: something else
-				panic(fmt.Sprintf("Couldn't create %s: %s", name, err.Error()))
-			}
-		} else {
-			//TODO: something else
-			panic(err)
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("couldn't stat %s: %s", name, err.Error())
+		}
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("couldn't create %s: %s", name, err.Error())
 		}
 	} else if !fif.IsDir() {
-		panic(fmt.Sprintf("%s isn't a directory!", name))
+		return fmt.Errorf("%s isn't a directory", name)
 	}
+	return nil
 }
 
 // UniqAppend takes the contents of one array and adds any content
-// not present in another array.
+// not present in another array. The result contains all of a, followed by
+// the elements of b that aren't in a, in the order they appear in b.
 func UniqAppend(a []string, b []string) []string {
-	ret := make([]string, 0, len(a)+len(b))
+	return UniqAppendG(a, b)
+}
+
+// UniqAppendG is UniqAppend for slices of any comparable type.
+func UniqAppendG[T comparable](a, b []T) []T {
+	ret := make([]T, 0, len(a)+len(b))
+	inA := make(map[T]Unit, len(a))
 	for _, e := range a {
 		ret = append(ret, e)
+		inA[e] = unit
 	}
-	// set ret = a
 
 	for _, be := range b {
-		add := true
-		for _, ae := range a {
-			if ae == be {
-				add = false
-				break
-			}
-		}
-		if add {
+		if _, ok := inA[be]; !ok {
 			ret = append(ret, be)
 		}
 	}
 	return ret
 }
 
-/*
-func uniqAppend(a []interface{}, b []interface{}) []interface{} {
-	eMap = map[interface{}]Unit
-	for _, e := range a {
-		eMap[e] := unit
-	}
-	for _, e := range b {
-		eMap[e] := unit
-	}
-
-	ret := make([]interface{}, 0, len(eMap))
-	for e, _ := range eMap {
-		ret := append(ret, e)
-	}
-	return ret
+// Dedup deduplicates a slice, keeping the first occurrence of each element
+// in its original order. The argument is left unmodified.
+func Dedup(a []string) []string {
+	return DedupG(a)
 }
-*/
 
-// Dedup deduplicates a slice
-func Dedup(a []string) []string {
-	length := len(a) - 1
-	for i := 0; i < length; i++ {
-		for j := i + 1; j <= length; j++ {
-			if a[i] == a[j] {
-				a[j] = a[length]
-				a = a[:length]
-				length--
-				j--
-			}
+// DedupG is Dedup for slices of any comparable type.
+func DedupG[T comparable](a []T) []T {
+	ret := make([]T, 0, len(a))
+	seen := make(map[T]Unit, len(a))
+	for _, e := range a {
+		if _, ok := seen[e]; !ok {
+			seen[e] = unit
+			ret = append(ret, e)
 		}
 	}
-	return a
+	return ret
 }
 
-// Combine puts together two maps of string keys and unit values.
+// Combine puts together two maps of string keys and unit values. Neither
+// argument is modified.
 func Combine(a, b map[string]Unit) map[string]Unit {
-	ret := a
+	ret := make(map[string]Unit, len(a)+len(b))
+	for e := range a {
+		ret[e] = unit
+	}
 	for e := range b {
 		ret[e] = unit
 	}
@@ -277,12 +701,34 @@ func StrMap(args ...string) map[string]Unit {
 
 // WriteJSON writes and encodes json dat.
 func WriteJSON(w io.Writer, data interface{}) error {
+	return WriteJSONIndent(w, data, "")
+}
+
+// WriteJSONIndent is WriteJSON, indenting each level of nesting of the output
+// with indent, such as "  ". An empty indent writes compact JSON on a single
+// line. As with WriteJSON, characters such as & and < aren't escaped.
+func WriteJSONIndent(w io.Writer, data interface{}, indent string) error {
 	enc := json.NewEncoder(w)
 	enc.SetEscapeHTML(false)
-	enc.SetIndent("", "")
+	enc.SetIndent("", indent)
 	return enc.Encode(data)
 }
 
+// WriteCSV writes header followed by rows to w as CSV. Fields containing
+// commas, quotes or newlines are quoted. header is skipped if it is nil.
+func WriteCSV(w io.Writer, header []string, rows [][]string) error {
+	cw := csv.NewWriter(w)
+	if header != nil {
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+	}
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
 // WriteDEAN Writes and Encodes a 'Nah Mate'.
 func WriteDEAN(w io.Writer, data interface{}) error {
 	w.Write([]byte("Nah\n"))
@@ -290,56 +736,3 @@ func WriteDEAN(w io.Writer, data interface{}) error {
 	w.Write([]byte("mate."))
 	return nil
 }
-
-// GetJSON from valid url string gets json
-func GetJSON(url string, target interface{}) error {
-	client := &http.Client{Timeout: 10 * time.Second}
-	r, err := client.Get(url)
-	if err != nil {
-		return err
-	}
-	if r.StatusCode != http.StatusOK {
-		return fmt.Errorf("Got status %d while attempting to get GeoIP data", r.StatusCode)
-	}
-	defer r.Body.Close()
-
-	return json.NewDecoder(r.Body).Decode(target)
-}
-
-// GeoIPInfo stores apphosts data for geolocation
-type GeoIPInfo struct {
-	IP          string  `json:"ip"`
-	CountryCode string  `json:"country_code"`
-	CountryName string  `json:"country_name"`
-	RegionCode  string  `json:"region_code"`
-	RegionName  string  `json:"region_name"`
-	City        string  `json:"city"`
-	ZipCode     string  `json:"zip_code"`
-	TimeZone    string  `json:"time_zone"`
-	Latitude    float64 `json:"latitude"`
-	Longitude   float64 `json:"longitude"`
-	MetroCode   int     `json:"metro_code"`
-}
-
-// GetHostGeoIP grabs geo location information from hostname
-func GetHostGeoIP(geoipHost, host string) ([]GeoIPInfo, error) {
-	hosts, err := net.LookupHost(host)
-	if err != nil {
-		return nil, err
-	}
-
-	ret := make([]GeoIPInfo, 0, len(hosts))
-	for _, host := range hosts {
-		var inf GeoIPInfo
-		//TODO: fix?
-		err = GetJSON(geoipHost+"/"+url.PathEscape(host), &inf)
-		if err != nil {
-			//TODO: better handling?
-			fmt.Printf("Couldn't lookup geoip info for %s: %s \n", host, err.Error())
-		} else {
-			ret = append(ret, inf)
-		}
-	}
-
-	return ret, nil
-}
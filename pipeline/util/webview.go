@@ -0,0 +1,141 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The smali references WebViewBridges looks for. Calls are matched whatever
+// class they're made through, so subclasses of WebView are covered.
+const (
+	addJSInterfaceRef = "->addJavascriptInterface(Ljava/lang/Object;Ljava/lang/String;)V"
+	setJSEnabledRef   = "->setJavaScriptEnabled(Z)V"
+	jsInterfaceRef    = "Landroid/webkit/JavascriptInterface;"
+)
+
+// smaliConstRe matches a smali instruction setting a register to a
+// constant, capturing the register and the value.
+var smaliConstRe = regexp.MustCompile(`^const(?:/4|/16)?\s+([vp]\d+),\s*(-?0x[0-9a-f]+|-?\d+)`)
+
+// smaliInvokeRegsRe matches the registers an invoke instruction passes,
+// capturing the list, e.g. "v0, v1", or range, e.g. "v0 .. v1".
+var smaliInvokeRegsRe = regexp.MustCompile(`^invoke-\S+\s+\{([^}]*)\}`)
+
+// WebViewBridges scans the smali output of the unpacked app for the places it
+// bridges WebView content and native code, returning them without duplicates
+// as "kind: method", with method given as in smali, e.g.
+// "addJavascriptInterface: Lcom/example/Web;->setup()V". The kinds are:
+//
+//   - addJavascriptInterface, for methods exposing an object to the
+//     JavaScript of a WebView;
+//   - setJavaScriptEnabled, for methods enabling JavaScript in a WebView,
+//     unless they are known to disable it instead; and
+//   - JavascriptInterface, for the methods annotated with
+//     @JavascriptInterface that JavaScript can call.
+//
+// Files are read a line at a time. It must be called after Unpack, and
+// returns ErrNoSmali if the app's code wasn't disassembled.
+func (app *App) WebViewBridges() ([]string, error) {
+	dirs, err := smaliDirs(app.OutDir())
+	if err != nil {
+		return nil, err
+	}
+
+	var bridges []string
+	for _, dir := range dirs {
+		err = filepath.Walk(dir, func(fname string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || path.Ext(fname) != ".smali" {
+				return nil
+			}
+			found, err := scanWebViewBridges(fname)
+			if err != nil {
+				return err
+			}
+			bridges = append(bridges, found...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return Dedup(bridges), nil
+}
+
+// scanWebViewBridges returns the WebView bridges in the smali file fname, as
+// described by WebViewBridges.
+func scanWebViewBridges(fname string) ([]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var bridges []string
+	var class, method string
+	// consts holds the constants the registers of the current method were
+	// last set to, as far as a linear scan can tell.
+	consts := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxSmaliLine)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, ".class "):
+			fields := strings.Fields(line)
+			class = fields[len(fields)-1]
+		case strings.HasPrefix(line, ".method "):
+			fields := strings.Fields(line)
+			method = class + "->" + fields[len(fields)-1]
+			consts = make(map[string]string)
+		case strings.HasPrefix(line, ".end method"):
+			method = ""
+		case method == "":
+		case strings.HasPrefix(line, ".annotation ") && strings.HasSuffix(line, jsInterfaceRef):
+			bridges = append(bridges, "JavascriptInterface: "+method)
+		case strings.Contains(line, addJSInterfaceRef):
+			bridges = append(bridges, "addJavascriptInterface: "+method)
+		case strings.Contains(line, setJSEnabledRef):
+			if value, ok := consts[lastInvokeReg(line)]; !ok || !isZero(value) {
+				bridges = append(bridges, "setJavaScriptEnabled: "+method)
+			}
+		default:
+			if m := smaliConstRe.FindStringSubmatch(line); m != nil {
+				consts[m[1]] = m[2]
+			} else if fields := strings.Fields(line); len(fields) > 1 && !strings.HasPrefix(line, ".") {
+				// Any other instruction may overwrite its first register.
+				delete(consts, strings.TrimSuffix(fields[1], ","))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't scan %s: %s", fname, err.Error())
+	}
+	return bridges, nil
+}
+
+// lastInvokeReg returns the last register passed by the smali invoke
+// instruction line, or the empty string if it can't be parsed.
+func lastInvokeReg(line string) string {
+	m := smaliInvokeRegsRe.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	regs := strings.FieldsFunc(m[1], func(r rune) bool { return r == ',' || r == ' ' || r == '.' })
+	if len(regs) == 0 {
+		return ""
+	}
+	return regs[len(regs)-1]
+}
+
+// isZero reports whether the smali constant value is zero.
+func isZero(value string) bool {
+	return strings.TrimLeft(strings.TrimPrefix(strings.TrimPrefix(value, "-"), "0x"), "0") == ""
+}